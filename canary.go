@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"goods.ru/grab-it/grabers"
+	lib "goods.ru/grab-it/libs"
+)
+
+// canaryCommand скачивает известные товарные страницы каждого сайта
+// и падает, если селекторы перестали находить обязательные поля.
+func canaryCommand(ctx context.Context, args []string) (error) {
+	flags := flag.NewFlagSet("canary", flag.ExitOnError)
+	siteName := flags.String("site", "", "check only this site")
+	flags.Parse(args)
+
+	sites, err := grabers.Select(*siteName)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, site := range sites {
+		urls, err := lib.ReadLines(site.CanaryUrls)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", site.Name, err)
+			continue
+		}
+
+		siteCtx, done, err := site.Session(ctx)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", site.Name, err)
+			continue
+		}
+		results, problems, err := lib.RunCanary(siteCtx, site.Name, urls, site.Charset, site.ParseFile, site.Health, site.CanaryPath)
+		done()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", site.Name, err)
+			continue
+		}
+		for _, r := range results {
+			if r.Err == nil && len(r.Problems) == 0 {
+				fmt.Printf("ok   %s %s\n", site.Name, r.Url)
+			}
+		}
+		if len(problems) > 0 {
+			failed++
+			fmt.Printf("FAIL %s: %d problem(s)\n", site.Name, len(problems))
+			for _, problem := range problems {
+				fmt.Println("     " + problem)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("canary failed for %d site(s)", failed)
+	}
+	return nil
+}
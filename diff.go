@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"goods.ru/grab-it/grabers"
+	lib "goods.ru/grab-it/libs"
+)
+
+// diffCommand сравнивает два каталога одного сайта. Без второго файла
+// старый каталог сравнивается с последним прогоном сайта.
+func diffCommand(ctx context.Context, args []string) (error) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	siteName := flags.String("site", "", "site the catalogs belong to")
+	jsonPath := flags.String("json", "", "also write the full diff as json to this file")
+	flags.Parse(args)
+
+	if *siteName == "" || flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	site, err := grabers.Get(*siteName)
+	if err != nil {
+		return err
+	}
+
+	oldPath := flags.Arg(0)
+	before, err := site.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	newPath := "latest run"
+	var after []*lib.Product
+	if flags.NArg() == 2 {
+		newPath = flags.Arg(1)
+		after, err = site.Open(newPath)
+	} else {
+		after, err = site.Products()
+	}
+	if err != nil {
+		return err
+	}
+
+	diff := lib.DiffCatalogs(site.Name, before, after)
+	diff.Old, diff.New = oldPath, newPath
+	diff.WriteSummary(os.Stdout)
+	if *jsonPath != "" {
+		return diff.Save(*jsonPath)
+	}
+	return nil
+}
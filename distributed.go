@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strconv"
+	"goods.ru/grab-it/grabers"
+	lib "goods.ru/grab-it/libs"
+)
+
+// coordinatorCommand раздает обход одного сайта воркерам.
+func coordinatorCommand(ctx context.Context, args []string) (error) {
+	flags := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	siteName := flags.String("site", "", "site to crawl")
+	listen := flags.String("listen", ":8700", "address for workers")
+	flags.Parse(args)
+
+	if *siteName == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	site, err := grabers.Get(*siteName)
+	if err != nil {
+		return err
+	}
+	ctx, done, err := site.Session(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return site.Coordinate(ctx, *listen)
+}
+
+// workerCommand берет у координатора адреса, качает и разбирает их.
+func workerCommand(ctx context.Context, args []string) (error) {
+	hostname, _ := os.Hostname()
+
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	siteName := flags.String("site", "", "site being crawled")
+	coordinator := flags.String("coordinator", "http://localhost:8700", "coordinator url")
+	parallel := flags.Int("parallel", 10, "pages fetched at once")
+	name := flags.String("name", hostname+"-"+strconv.Itoa(os.Getpid()), "worker name in coordinator status")
+	flags.Parse(args)
+
+	if *siteName == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	site, err := grabers.Get(*siteName)
+	if err != nil {
+		return err
+	}
+
+	ctx, done, err := site.Session(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	worker := &lib.Worker{Name: *name, Coordinator: *coordinator, Source: site.Source, Parallel: *parallel}
+	worker.Progress = lib.NewProgress(site.Name, "worker", 0)
+	defer worker.Progress.Finish()
+	return worker.Run(ctx)
+}
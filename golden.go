@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"goods.ru/grab-it/grabers"
+	lib "goods.ru/grab-it/libs"
+)
+
+// goldenCommand прогоняет парсеры по сохраненным страницам из testdata
+// и сравнивает результат с эталонами.
+func goldenCommand(ctx context.Context, args []string) (error) {
+	flags := flag.NewFlagSet("golden", flag.ExitOnError)
+	update := flags.Bool("update", false, "rewrite golden files from current parser output")
+	siteName := flags.String("site", "", "check only this site")
+	flags.Parse(args)
+
+	sites, err := grabers.Select(*siteName)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, site := range sites {
+		results, err := lib.CheckGolden(site.Fixtures, site.ParseFile, *update)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			switch {
+			case r.Err != nil:
+				failed++
+				fmt.Printf("FAIL %s: %v\n", r.Fixture, r.Err)
+			case r.Diff != "":
+				failed++
+				fmt.Printf("FAIL %s\n--- %s\n+++ parsed\n%s", r.Fixture, r.Golden, r.Diff)
+			case r.Updated:
+				fmt.Printf("UPDATED %s\n", r.Golden)
+			default:
+				fmt.Printf("ok   %s\n", r.Fixture)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d golden check(s) failed", failed)
+	}
+	return nil
+}
+
+// captureCommand сохраняет живую страницу как новую фикстуру.
+func captureCommand(ctx context.Context, args []string) (error) {
+	flags := flag.NewFlagSet("capture", flag.ExitOnError)
+	siteName := flags.String("site", "", "site the page belongs to")
+	name := flags.String("name", "", "fixture name without extension")
+	flags.Parse(args)
+
+	if *siteName == "" || *name == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	site, err := grabers.Get(*siteName)
+	if err != nil {
+		return err
+	}
+
+	ctx, done, err := site.Session(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	r, err := lib.CaptureFixture(ctx, flags.Arg(0), site.Fixtures, *name, site.Charset, site.ParseFile)
+	if err != nil {
+		return err
+	}
+	if r.Err != nil {
+		return r.Err
+	}
+	fmt.Printf("captured %s, review %s before committing\n", r.Fixture, r.Golden)
+	return nil
+}
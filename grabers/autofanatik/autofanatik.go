@@ -1,54 +1,85 @@
 package autofanatik
 
 import (
+	"context"
 	"encoding/xml"
 	"os"
-	"log"
 	"strconv"
 	"github.com/PuerkitoBio/goquery"
-	"fmt"
-	"path"
+	"io"
 	"io/ioutil"
-	"strings"
-	"sync"
+	"time"
 	lib "goods.ru/grab-it/libs"
 )
 
 const (
+	Name               = "autofanatik"
 	BaseUrl            = "http://autofanatik.ru"
 	SipeMapUrl         = "http://autofanatik.ru/sitemap.xml"
 	DataPath           = "grabers/autofanatik/data/"
 	PagesDataPath      = DataPath + "pages/"
 	ImagesDataPath     = DataPath + "images/"
+	VariantsPath       = ImagesDataPath + "variants/"
 	SiteMapPath        = DataPath + "sitemap.xml"
 	CatalogPath        = DataPath + "/catalog.xml"
-	Catalog0Path       = DataPath + "/catalog0.xml"
-	Catalog1Path       = DataPath + "/catalog1.xml"
-	Catalog2Path       = DataPath + "/catalog2.xml"
-	Catalog3Path       = DataPath + "/catalog3.xml"
-	CatalogUnknownPath = DataPath + "/catalog4.xml"
+	ImagedCatalogPath  = DataPath + "/icatalog.xml"
+	QuarantinePath     = DataPath + "quarantine/"
+	ErrorsPath         = DataPath + "/errors.xml"
+	StatsPath          = DataPath + "/fieldstats.xml"
+	CanaryPath         = DataPath + "/canary.xml"
+	CanaryUrlsPath     = DataPath + "/canary.txt"
+	VariantsConfigPath = DataPath + "/variants.json"
+	PlaceholdersPath   = DataPath + "/placeholders.xml"
+	SharedImagesPath   = DataPath + "/shared-images.xml"
+	ProductsPath       = DataPath + "/products.xml"
+	StatePath          = DataPath + "/crawl-state.json"
+	ProfilePath        = DataPath + "/profile.json"
+	RegionsPath        = DataPath + "/regions.json"
+	HistoryPath        = DataPath + "/history.csv"
 )
 
 const (
-	// Необходимо отрезать первый символ
-	ENCODE_TYPE_1 = "1"
-	// Совпадение с артикулом по N-1 символам
-	ENCODE_TYPE_2 = "2"
-	// Полное совпадение с артикулом
-	ENCODE_TYPE_3 = "3"
-	// Неизвестно
-	ENCODE_TYPE_UNKNOWN = "Unknown"
+	ImageWorkers        = 10
+	ImageWorkersPerHost = 4
 )
 
+// Ссылки на картинки здесь часто битые, поэтому в потоковом режиме
+// картинки не качаются: их чинит и качает обычный этап repair/images.
+var Stream = &lib.StreamSource{
+	Site:       Name,
+	SiteMapUrl: SipeMapUrl,
+	Parse:      ParseReader,
+	// Адреса товаров без общего вида, только метки переходов
+	Canonical: lib.DefaultCanonicalRules,
+}
+
+// Сохраненные страницы и эталоны для golden
+var FixturesPath = lib.FixturesDir()
+
+var Health = &lib.HealthRules{
+	Required: []string{"name"},
+	MinRate:  map[string]float64{"article": 0.9, "price": 0.9, "images": 0.8},
+	MaxDrop:  0.2,
+}
+
+// Ссылки на картинки на сайте часто битые: к артикулу в имени файла
+// приклеен лишний символ или отрезан хвост.
+var repairer = lib.NewRepairer(lib.AsIs{}, lib.TrimBeforeArticle{}, lib.ArticleDigitsPrefix{Tail: 2})
+
 type FixedUrl struct {
 	SourceUrl  string `xml:"source"`
 	FixedUrl   string `xml:"fixed"`
-	EncodeType string `xml:"encodeType"`
-	FileName   string `xml:"image"`
+	Strategy   string  `xml:"strategy,omitempty"`
+	Confidence float64 `xml:"confidence,omitempty"`
+	FileName   string  `xml:"image"`
+	lib.ImageInfo
+	Variants []*lib.ImageVariant `xml:"variants>variant"`
 }
 
 type CatalogItem struct {
 	XMLName     xml.Name    `xml:"item"`
+	Url         string      `xml:"url,omitempty"`
+	Aliases     []string    `xml:"alias,omitempty"`
 	Name        string      `xml:"name"`
 	Collection  string      `xml:"collection"`
 	Description string      `xml:"description"`
@@ -72,11 +103,11 @@ type SiteMapUrls struct {
 	Urls    []*SiteMapUrl `xml:"url"`
 }
 
-func getSiteMap() (error) {
-	return lib.DownloadAndSave(SipeMapUrl, SiteMapPath, "")
+func getSiteMap(ctx context.Context) (error) {
+	return lib.DownloadAndSaveContext(ctx, SipeMapUrl, SiteMapPath, "")
 }
 
-func getPages() (error) {
+func getPages(ctx context.Context) (error) {
 
 	f, err := os.Open(SiteMapPath);
 	if err != nil {
@@ -87,13 +118,34 @@ func getPages() (error) {
 	siteMap := new(SiteMapUrls)
 	xml.NewDecoder(f).Decode(siteMap)
 
-	log.Println("Start downloads " + strconv.Itoa(len(siteMap.Urls)) + " files")
+	// Один товар бывает в карте сайта под несколькими адресами
+	pages := make(map[int]string)
+	seen := make(map[string]bool)
 	for index, url := range siteMap.Urls {
+		if pageUrl := Stream.Canonical.Canonical(url.Url); !seen[pageUrl] {
+			seen[pageUrl] = true
+			pages[index] = pageUrl
+		}
+	}
+
+	progress := lib.NewProgress(Name, "pages", len(pages))
+	defer progress.Finish()
+	for index := range siteMap.Urls {
+		pageUrl, ok := pages[index]
+		if !ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		fileName := PagesDataPath + "page" + strconv.Itoa(index) + ".html"
-		log.Println("** " + strconv.Itoa(index) + ".html :" + url.Url)
-		if err := lib.DownloadAndSave(url.Url, fileName, ""); err != nil {
-			log.Println(err);
+		if err := lib.DownloadPageContext(ctx, pageUrl, fileName, ""); err != nil {
+			lib.L(ctx).Warn("page download failed", "url", pageUrl, "file", fileName, "error", err)
+			progress.Fail()
+			continue
 		}
+		progress.Done()
+		progress.AddFile(fileName)
 	}
 
 	return nil
@@ -103,20 +155,29 @@ func parsePage(filename string) (*CatalogItem, error) {
 
 	f, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, lib.FetchError(filename, lib.PageUrl(filename), err)
 	}
 	defer f.Close()
-	log.Println(f.Name())
 
-	item := new(CatalogItem)
-	doc, err := goquery.NewDocumentFromReader(f)
+	return parseDocument(f, lib.PageUrl(filename), filename)
+}
+
+func parseDocument(r io.Reader, pageUrl string, filename string) (*CatalogItem, error) {
+
+	item := &CatalogItem{Url: pageUrl}
+	doc, err := goquery.NewDocumentFromReader(r)
 	if err != nil {
-		log.Fatal(err)
+		return nil, lib.DecodeError(filename, pageUrl, err)
+	}
+
+	if len(doc.Find(".good_title").Nodes) == 0 {
+		return nil, lib.NotProductError(filename, pageUrl, "no .good_title block")
 	}
+	base := lib.DocumentBase(pageUrl, doc, BaseUrl)
 
 	title := doc.Find(".good_title h1")
 	if len(title.Nodes) == 0 {
-		return nil, fmt.Errorf("no title")
+		return nil, lib.MissingFieldError(filename, pageUrl, "name")
 	}
 	item.Name = title.Text()
 
@@ -142,28 +203,54 @@ func parsePage(filename string) (*CatalogItem, error) {
 
 	item.Urls = make([]string, 0)
 	image, ok := doc.Find("td.good_img a").Attr("href")
-	if (ok) {
-		item.Urls = append(item.Urls, BaseUrl+image)
-	}
-
-	addImages := doc.Find("td.good_img div.add_img_previews a")
-	if len(addImages.Nodes) > 0 {
-		for _, node := range addImages.Nodes {
-			for _, attr := range node.Attr {
-				if attr.Key != "href" {
-					continue
-				}
-				d, f := path.Split(attr.Val)
-				imgUrl := BaseUrl + d + f
-				item.Urls = append(item.Urls, imgUrl)
-			}
-		}
+	if imgUrl := lib.ResolveUrl(base, image); ok && imgUrl != "" {
+		item.Urls = append(item.Urls, imgUrl)
 	}
 
+	doc.Find("td.good_img div.add_img_previews a[href]").Each(func(i int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		if imgUrl := lib.ResolveUrl(base, href); imgUrl != "" {
+			item.Urls = append(item.Urls, imgUrl)
+		}
+	})
+
 	return item, nil
 }
 
-func parsePages() (*Catalog, error) {
+func toProduct(item *CatalogItem) (*lib.Product) {
+	return &lib.Product{
+		Site:        Name,
+		Url:         item.Url,
+		Aliases:     item.Aliases,
+		Name:        item.Name,
+		Article:     item.Article,
+		Collection:  item.Collection,
+		Price:       item.Price,
+		Description: item.Description,
+		Images:      item.Urls,
+	}
+}
+
+// ParseFile разбирает сохраненную страницу в общий формат товара.
+func ParseFile(filename string) (*lib.Product, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, lib.FetchError(filename, lib.PageUrl(filename), err)
+	}
+	defer f.Close()
+	return ParseReader(f, lib.PageUrl(filename), filename)
+}
+
+// ParseReader разбирает страницу из потока в общий формат товара.
+func ParseReader(r io.Reader, pageUrl string, name string) (*lib.Product, error) {
+	item, err := parseDocument(r, pageUrl, name)
+	if err != nil {
+		return nil, err
+	}
+	return toProduct(item), nil
+}
+
+func parsePages(ctx context.Context) (*Catalog, error) {
 
 	d, err := ioutil.ReadDir(PagesDataPath)
 	if err != nil {
@@ -173,21 +260,66 @@ func parsePages() (*Catalog, error) {
 	catalog := new(Catalog)
 	catalog.Items = make([]*CatalogItem, 0)
 
+	report := lib.NewParseReport(Name, "parse", lib.RunOf(ctx))
+	stats := lib.NewFieldStats(Name, lib.RunOf(ctx))
+	duplicates := lib.NewDuplicateFilter()
+	progress := lib.NewProgress(Name, "parse", len(d))
+	defer progress.Finish()
 	for _, item := range d {
-		if item.IsDir() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if item.IsDir() || !lib.IsPageFile(item.Name()) {
+			progress.Done()
+			continue
+		}
+		fileName := PagesDataPath + item.Name()
+		progress.AddFile(fileName)
+		catalogItem, err := parsePage(fileName);
+		if lib.IsNotProduct(err) {
+			report.NotProduct(fileName)
+			progress.Done()
 			continue
 		}
-		catalogItem, err := parsePage(PagesDataPath + item.Name());
 		if err != nil {
-			log.Println(err)
+			report.Add(fileName, err)
+			lib.L(ctx).Warn("page not parsed", "file", fileName, "error", err)
+			progress.Fail()
+			continue
 		}
-		if catalogItem != nil {
-			catalog.Items = append(catalog.Items, catalogItem)
+		report.Ok()
+		progress.Done()
+		product := toProduct(catalogItem)
+		lib.CanonicalPage(Stream, product, fileName)
+		catalogItem.Url, catalogItem.Aliases = product.Url, product.Aliases
+		if first, i, ok := duplicates.Merge(product); ok {
+			catalog.Items[i].Aliases = first.Aliases
+			lib.L(ctx).Info("duplicate page merged", "file", fileName, "into", first.Url)
+			continue
 		}
+		stats.Add(product)
+		catalog.Items = append(catalog.Items, catalogItem)
+	}
+
+	lib.CheckRun(ctx, Health, stats, StatsPath)
+
+	if err := report.Quarantine(QuarantinePath); err != nil {
+		lib.L(ctx).Error("quarantine failed", "file", QuarantinePath, "error", err)
+	}
+	if err := report.Save(ErrorsPath); err != nil {
+		lib.L(ctx).Error("parse report not saved", "file", ErrorsPath, "error", err)
 	}
 	return catalog, nil
 }
 
+func parse(ctx context.Context) (error) {
+	catalog, err := parsePages(ctx)
+	if err != nil {
+		return err
+	}
+	return saveCatalog(catalog, CatalogPath)
+}
+
 func saveCatalog(catalog *Catalog, filename string) (error) {
 	sf, err := os.Create(filename)
 	if err != nil {
@@ -208,204 +340,280 @@ func openCatalog(filename string) (*Catalog, error) {
 	return catalog, nil
 }
 
-func findImages() (error) {
+func findImages(ctx context.Context) (error) {
 	catalog, err := openCatalog(CatalogPath)
 	if err != nil {
 		return err
 	}
 
-	catalog0 := new(Catalog)
-	catalog1 := new(Catalog)
-	catalog2 := new(Catalog)
-	catalog3 := new(Catalog)
-	catalogUnknown := new(Catalog)
-
-	catalog0.Items = make([]*CatalogItem, 0)
-	catalog1.Items = make([]*CatalogItem, 0)
-	catalog2.Items = make([]*CatalogItem, 0)
-	catalog3.Items = make([]*CatalogItem, 0)
-	catalogUnknown.Items = make([]*CatalogItem, 0)
-
+	repaired, failed := 0, 0
+	progress := lib.NewProgress(Name, "repair", len(catalog.Items))
+	defer progress.Finish()
 	for _, item := range catalog.Items {
-		item.FixedUrls = make([]*FixedUrl, 0)
-
-		magicNumber := ""
-		for i, _ := range item.Article {
-			if _, err := strconv.Atoi(item.Article[i : i+1]); err != nil {
-				break;
-			}
-			magicNumber = magicNumber + item.Article[i:i+1]
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+		progress.Done()
+		item.FixedUrls = make([]*FixedUrl, 0)
+		hints := &lib.RepairHints{Article: item.Article}
 
 		for _, url := range item.Urls {
 			fixedUrl := new(FixedUrl)
 			fixedUrl.SourceUrl = url
-			fixedUrl.EncodeType = ENCODE_TYPE_UNKNOWN
-			d, f := path.Split(url)
-
-			if strings.Index(f, item.Article) > 0 {
-				fixedUrl.EncodeType = ENCODE_TYPE_1
-			} else if strings.Index(f, item.Article) == 0 {
-				fixedUrl.EncodeType = ENCODE_TYPE_3
-			} else if strings.Index(f, item.Article[:len(item.Article)-2]) == 0 {
-				fixedUrl.EncodeType = ENCODE_TYPE_2
-			}
-
-			if fixedUrl.EncodeType == ENCODE_TYPE_1 {
-				fixedUrl.FixedUrl = d + f[strings.Index(f, item.Article):]
-			}
 
-			if fixedUrl.EncodeType == ENCODE_TYPE_2 {
-				if err != nil {
-					log.Println(err)
-				}
-				f = magicNumber + f[len(magicNumber):]
-				fixedUrl.FixedUrl = d + f
+			if r := repairer.Repair(ctx, url, hints); r != nil {
+				fixedUrl.FixedUrl = r.Url
+				fixedUrl.Strategy = r.Strategy
+				fixedUrl.Confidence = r.Confidence
+				repaired++
+			} else {
+				lib.L(ctx).Warn("no working image url", "url", url, "article", item.Article)
+				failed++
 			}
 
 			item.FixedUrls = append(item.FixedUrls, fixedUrl)
-
 		}
+	}
 
-		if len(item.FixedUrls) > 0 {
-			if item.FixedUrls[0].EncodeType == ENCODE_TYPE_1 {
-				catalog1.Items = append(catalog1.Items, item)
-			}
+	lib.L(ctx).Info("image urls repaired", "found", repaired, "notFound", failed)
+	return saveCatalog(catalog, ImagedCatalogPath)
+}
 
-			if item.FixedUrls[0].EncodeType == ENCODE_TYPE_2 {
-				catalog2.Items = append(catalog2.Items, item)
-			}
+func downloadCatalogImages(ctx context.Context, catalog *Catalog, pool *lib.ImagePool) {
 
-			if item.FixedUrls[0].EncodeType == ENCODE_TYPE_3 {
-				catalog3.Items = append(catalog3.Items, item)
+	jobs := make([]*lib.ImageJob, 0)
+	targets := make([]*FixedUrl, 0)
+	for index, item := range catalog.Items {
+		for j, fixedUrl := range item.FixedUrls {
+			if fixedUrl.FixedUrl == "" {
+				continue
 			}
+			jobs = append(jobs, &lib.ImageJob{Url: fixedUrl.FixedUrl, Name: lib.ImageName("", index, j)})
+			targets = append(targets, fixedUrl)
+		}
+	}
 
-			if item.FixedUrls[0].EncodeType == ENCODE_TYPE_UNKNOWN {
-				catalogUnknown.Items = append(catalogUnknown.Items, item)
-			}
-		} else {
-			catalog0.Items = append(catalog0.Items, item)
+	pool.Progress = lib.NewProgress(Name, "images", len(jobs))
+	defer pool.Progress.Finish()
+	for i, r := range pool.RunContext(ctx, jobs) {
+		if r.Err != nil {
+			lib.L(ctx).Warn("image download failed", "url", r.Job.Url, "error", r.Err)
+			continue
 		}
+		targets[i].FileName = r.File;
+		targets[i].ImageInfo = *r.Info
 	}
+}
+
+func downloadImages(ctx context.Context) (error) {
 
-	err = saveCatalog(catalog0, Catalog0Path)
+	store, err := lib.NewImageStore(ImagesDataPath)
 	if err != nil {
 		return err
 	}
-	//err = saveCatalog(catalog1, Catalog1Path)
-	//if err != nil {
-	//	return err
-	//}
-	//err = saveCatalog(catalog2, Catalog2Path)
-	//if err != nil {
-	//	return err
-	//}
-	err = saveCatalog(catalog3, Catalog3Path)
+
+	catalog, err := openCatalog(ImagedCatalogPath)
 	if err != nil {
 		return err
 	}
-	err = saveCatalog(catalogUnknown, CatalogUnknownPath)
-	if err != nil {
+
+	pool := lib.NewImagePool(store, ImageWorkers, ImageWorkersPerHost)
+	downloadCatalogImages(ctx, catalog, pool)
+	// При отмене сохраняем то, что успели скачать
+	if err := saveCatalog(catalog, ImagedCatalogPath); err != nil {
 		return err
 	}
-
-	return nil
+	return ctx.Err()
 }
 
-var i int = 0
-
-func getNextImageName() (string) {
-	var m = sync.Mutex{}
-	m.Lock()
-	i++
-	m.Unlock()
-	index := strconv.Itoa(i)
-	return strings.Repeat("0", 10-len(index)) + index
-}
-
-func downloadCatalogImages(catalog *Catalog, prefix string) {
-
-	dc := make(chan string, 10)
-	ec := make(chan error, 10)
-
-	total := len(catalog.Items)
-	for index, item := range catalog.Items {
+// findPlaceholders ищет картинки, общие для многих товаров, и помечает
+// заглушки "нет фото" в каталоге, скачанном downloadImages.
+func findPlaceholders(ctx context.Context) (error) {
+	blacklist, err := lib.OpenPlaceholders(PlaceholdersPath)
+	if err != nil {
+		return err
+	}
 
-		log.Println(prefix + "(" + strconv.Itoa(index+1) + "/" + strconv.Itoa(total) + ") " + item.Name)
+	catalog, err := openCatalog(ImagedCatalogPath)
+	if err != nil {
+		return err
+	}
 
+	refs := make([]*lib.ImageRef, 0)
+	for i, item := range catalog.Items {
+		// Без артикула товар различаем по адресу, без адреса - по номеру
+		product := item.Article
+		if product == "" {
+			product = item.Url
+		}
+		if product == "" {
+			product = "#" + strconv.Itoa(i)
+		}
 		for _, fixedUrl := range item.FixedUrls {
+			if fixedUrl.FileName != "" {
+				refs = append(refs, &lib.ImageRef{Product: product, File: fixedUrl.FileName, DHash: fixedUrl.DHash, Info: &fixedUrl.ImageInfo})
+			}
+		}
+	}
 
-			_, f := path.Split(fixedUrl.FixedUrl)
-			e := path.Ext(f)
-			imageName := getNextImageName() + e
-			imagePath := ImagesDataPath + imageName
-
-			go lib.DownloadAndSaveChan(fixedUrl.FixedUrl, imagePath, dc, ec)
+	report := lib.FindSharedImages(Name, refs, blacklist, lib.DefaultSharedImageOptions)
+	lib.L(ctx).Info("shared images found", "clusters", len(report.Clusters), "onlyPlaceholders", len(report.OnlyPlaceholders))
+	if err := lib.SavePlaceholders(blacklist, PlaceholdersPath); err != nil {
+		return err
+	}
+	if err := lib.SaveSharedImagesReport(report, SharedImagesPath); err != nil {
+		return err
+	}
+	return saveCatalog(catalog, ImagedCatalogPath)
+}
 
-			select {
-			case <-dc:
-				fixedUrl.FileName = imageName;
-			case err := <-ec:
-				log.Println(err)
+func makeCatalogVariants(ctx context.Context, catalog *Catalog, variants []*lib.Variant) {
+	done := make(map[string][]*lib.ImageVariant)
+	progress := lib.NewProgress(Name, "variants", len(catalog.Items))
+	defer progress.Finish()
+	for _, item := range catalog.Items {
+		if ctx.Err() != nil {
+			return
+		}
+		progress.Done()
+		for _, fixedUrl := range item.FixedUrls {
+			if fixedUrl.FileName == "" {
+				continue
+			}
+			if v, ok := done[fixedUrl.FileName]; ok {
+				fixedUrl.Variants = v
+				continue
+			}
+			v, err := lib.MakeVariants(ImagesDataPath+fixedUrl.FileName, VariantsPath, variants)
+			if err != nil {
+				lib.L(ctx).Warn("image variants failed", "file", fixedUrl.FileName, "error", err)
+				continue
 			}
+			fixedUrl.Variants = v
+			done[fixedUrl.FileName] = v
 		}
 	}
-
-	close(dc)
-	close(ec)
 }
 
-func downloadImages() (error) {
+// makeVariants строит уменьшенные копии картинок, скачанных downloadImages.
+func makeVariants(ctx context.Context) (error) {
+	variants, err := lib.LoadVariants(VariantsConfigPath)
+	if err != nil {
+		return err
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	catalog, err := openCatalog(ImagedCatalogPath)
+	if err != nil {
+		return err
+	}
+	makeCatalogVariants(ctx, catalog, variants)
+	if err := saveCatalog(catalog, ImagedCatalogPath); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
 
-	go func() {
-		catalog1, err := openCatalog(Catalog1Path)
-		if err != nil {
-			log.Println(err)
-		}
-		downloadCatalogImages(catalog1, "C1")
-		saveCatalog(catalog1, Catalog1Path)
-		wg.Done()
-	}()
+var Stages = []*lib.Stage{
+	{Name: "sitemap", Run: getSiteMap},
+	{Name: "pages", Run: getPages},
+	{Name: "parse", Run: parse},
+	{Name: "repair", Run: findImages},
+	{Name: "images", Run: downloadImages},
+	{Name: "placeholders", Run: findPlaceholders},
+	{Name: "variants", Run: makeVariants},
+}
 
-	go func() {
-		catalog2, err := openCatalog(Catalog2Path)
-		if err != nil {
-			log.Println(err)
-		}
-		downloadCatalogImages(catalog2, "C2")
-		saveCatalog(catalog2, Catalog2Path)
-		wg.Done()
-	}()
+// RunStream качает, разбирает и сохраняет товары одним потоком, без
+// промежуточных файлов. С keepPages сырые страницы тоже сохраняются.
+func RunStream(ctx context.Context, keepPages bool) (error) {
+	config := lib.DefaultPipelineConfig
+	if keepPages {
+		config.PagesDir = PagesDataPath
+	}
+	return lib.RunStream(ctx, Stream, config, ProductsPath, ErrorsPath, Health, StatsPath)
+}
 
-	wg.Wait()
-	return nil
+// Regions добавляет к товарам потокового режима цены и наличие по
+// регионам из RegionsPath.
+func Regions(ctx context.Context) (error) {
+	return lib.RunRegions(ctx, Stream, RegionsPath, ProductsPath)
 }
 
-func Run() (error) {
+// Coordinate раздает обход сайта воркерам, см. lib.RunCoordinator.
+func Coordinate(ctx context.Context, listen string) (error) {
+	return lib.RunCoordinator(ctx, Stream, listen, ProductsPath, StatePath, ErrorsPath, Health, StatsPath)
+}
+
+func Run(ctx context.Context) (error) {
+
+	return getSiteMap(ctx);
 
-	return getSiteMap();
+	//getPages(ctx)
 
-	//getPages()
+	//if err := parse(ctx); err != nil {
+	//	log.Fatal(err)
+	//}
 
-	//catalog, err := parsePages()
-	//if err != nil {
-	//	log.Print(err)
+	//if err := findImages(ctx); err != nil {
+	//	log.Fatal(err)
 	//}
-	//
-	//if catalog != nil {
-	//	if err := saveCatalog(catalog, CatalogPath); err != nil {
-	//		log.Fatal(err)
-	//	}
+
+	//if err := downloadImages(ctx); err != nil {
+	//	log.Fatal(err)
 	//}
 
-	//if err := findImages(); err != nil {
+	//if err := findPlaceholders(ctx); err != nil {
 	//	log.Fatal(err)
 	//}
 
-	//if err := downloadImages(); err != nil {
+	//if err := makeVariants(ctx); err != nil {
 	//	log.Fatal(err)
 	//}
 }
+
+// Products возвращает товары последнего прогона: из потокового режима
+// или из каталога стадий, смотря что новее.
+func Products() ([]*lib.Product, error) {
+	filename, err := latestFile()
+	if err != nil {
+		return nil, err
+	}
+	return Open(filename)
+}
+
+func latestFile() (string, error) {
+	return lib.LatestFile(ProductsPath, ImagedCatalogPath, CatalogPath)
+}
+
+// History дописывает цены и наличие последнего прогона в HistoryPath,
+// если товары обновились после since.
+func History(ctx context.Context, since time.Time) (error) {
+	filename, err := latestFile()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return lib.RecordHistory(ctx, HistoryPath, filename, since, Open)
+}
+
+// Open читает товары из файла потокового режима или из каталога сайта.
+func Open(filename string) ([]*lib.Product, error) {
+	isProducts, err := lib.IsProductsFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if isProducts {
+		return lib.OpenProducts(filename)
+	}
+	catalog, err := openCatalog(filename)
+	if err != nil {
+		return nil, err
+	}
+	products := make([]*lib.Product, 0, len(catalog.Items))
+	for _, item := range catalog.Items {
+		products = append(products, toProduct(item))
+	}
+	return products, nil
+}
@@ -1,29 +1,73 @@
 package compyou
 
 import (
+	"context"
 	lib "goods.ru/grab-it/libs"
 	"encoding/xml"
 	"os"
-	"log"
+	"path"
 	"strconv"
 	"io/ioutil"
 	"github.com/PuerkitoBio/goquery"
 	"io"
 	"github.com/djimenez/iconv-go"
-	"gopkg.in/cheggaaa/pb.v1"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
+	Name           = "compyou"
+	Charset        = "windows-1251"
+	BaseUrl        = "http://compyou.ru/"
 	SipeMapUrl     = "http://compyou.ru/sitemap.xml"
 	DataPath       = "/Users/vodolazov/go-data/compyou/"
 	PagesDataPath  = DataPath + "pages/"
 	ImagesDataPath = DataPath + "images/"
+	VariantsPath   = ImagesDataPath + "variants/"
 	SiteMapPath    = DataPath + "sitemap.xml"
 	CatalogPath    = DataPath + "/catalog.xml"
 	ImagedCatalogPath    = DataPath + "/icatalog.xml"
+	QuarantinePath = DataPath + "quarantine/"
+	ErrorsPath     = DataPath + "/errors.xml"
+	StatsPath      = DataPath + "/fieldstats.xml"
+	CanaryPath     = DataPath + "/canary.xml"
+	CanaryUrlsPath = DataPath + "/canary.txt"
+	VariantsConfigPath = DataPath + "/variants.json"
+	PlaceholdersPath   = DataPath + "/placeholders.xml"
+	SharedImagesPath   = DataPath + "/shared-images.xml"
+	ProductsPath       = DataPath + "/products.xml"
+	ProfilePath        = DataPath + "/profile.json"
+	RegionsPath        = DataPath + "/regions.json"
+	HistoryPath        = DataPath + "/history.csv"
+	StatePath          = DataPath + "/crawl-state.json"
 )
 
+const (
+	ImageWorkers        = 10
+	ImageWorkersPerHost = 4
+)
+
+var Stream = &lib.StreamSource{
+	Site:       Name,
+	SiteMapUrl: SipeMapUrl,
+	Filter:     isProductUrl,
+	Charset:    Charset,
+	Parse:      ParseReader,
+	// Товар - путь с косой чертой в конце, параметры не нужны; регистр
+	// пути важен ("/PC/")
+	Canonical: &lib.CanonicalRules{StripParams: []string{"*"}, TrailingSlash: lib.TrailingSlashAdd},
+}
+
+// Сохраненные страницы и эталоны для golden
+var FixturesPath = lib.FixturesDir()
+
+var Health = &lib.HealthRules{
+	Required: []string{"name"},
+	MinRate:  map[string]float64{"attributes": 0.9, "images": 0.8},
+	MaxDrop:  0.2,
+}
+
 type SiteMapUrl struct {
 	Url string `xml:"loc"`
 }
@@ -48,11 +92,17 @@ type AttributeGroup struct {
 type Image struct {
 	Url  string `xml:"url"`
 	File string `xml:"file"`
+	lib.ImageInfo
+	Variants []*lib.ImageVariant `xml:"variants>variant"`
 }
 
 type CatalogItem struct {
 	XMLName         xml.Name          `xml:"item"`
+	Url             string            `xml:"url,omitempty"`
+	Aliases         []string          `xml:"alias,omitempty"`
 	Name            string            `xml:"name"`
+	Price           string            `xml:"price,omitempty"`
+	Availability    string            `xml:"availability,omitempty"`
 	AttributeGroups []*AttributeGroup `xml:"groups>group"`
 	Images          []*Image          `xml:"images>image"`
 }
@@ -82,20 +132,15 @@ func openCatalog(filename string) (*Catalog, error) {
 	return catalog, nil
 }
 
-func getSiteMap() (error) {
-	return lib.DownloadAndSave(SipeMapUrl, SiteMapPath, "")
+func getSiteMap(ctx context.Context) (error) {
+	return lib.DownloadAndSaveContext(ctx, SipeMapUrl, SiteMapPath, "")
 }
 
-func getPage(index int, url *SiteMapUrl, c chan struct{}, e chan error) {
-	fileName := PagesDataPath + "page" + strconv.Itoa(index) + ".html"
-	log.Println("** " + strconv.Itoa(index) + ".html :" + url.Url)
-	if err := lib.DownloadAndSave(url.Url, fileName, ""); err != nil {
-		e <- err
-	}
-	c <- struct{}{}
+func isProductUrl(url string) (bool) {
+	return strings.Contains(url, "/PC/")
 }
 
-func getPages() (error) {
+func getPages(ctx context.Context) (error) {
 	f, err := os.Open(SiteMapPath);
 	if err != nil {
 		return err
@@ -105,26 +150,49 @@ func getPages() (error) {
 	siteMap := new(SiteMapUrls)
 	xml.NewDecoder(f).Decode(siteMap)
 
-	log.Println("Start downloads " + strconv.Itoa(len(siteMap.Urls)) + " files")
+	// Один товар бывает в карте сайта под несколькими адресами
+	pages := make(map[int]string)
+	seen := make(map[string]bool)
+	for index, url := range siteMap.Urls {
+		if !isProductUrl(url.Url) {
+			continue
+		}
+		if pageUrl := Stream.Canonical.Canonical(url.Url); !seen[pageUrl] {
+			seen[pageUrl] = true
+			pages[index] = pageUrl
+		}
+	}
 
-	bar := pb.StartNew(len(siteMap.Urls)).Prefix("Total")
-	bar.SetWidth(80)
-	bar.ShowSpeed = true
-	bar.Start()
+	progress := lib.NewProgress(Name, "pages", len(pages))
+	defer progress.Finish()
 
-	finded := 0
 	sem := make(chan struct{}, 10)
-	for index, url := range siteMap.Urls {
-		bar.Increment()
-		if !strings.Contains(url.Url, "/PC/") {
-			continue;
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for index := range siteMap.Urls {
+		pageUrl, ok := pages[index]
+		if !ok {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		sem <- struct{}{}
-		finded++
-		bar.Postfix(", find: " + strconv.Itoa(finded))
 
 		fileName := PagesDataPath + "page" + strconv.Itoa(index) + ".html"
-		go lib.DownloadAndSaveSem(url.Url, fileName, sem, "windows-1251")
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := lib.DownloadPageContext(ctx, url, fileName, Charset); err != nil {
+				lib.L(ctx).Warn("page download failed", "url", url, "file", fileName, "error", err)
+				progress.Fail()
+				return
+			}
+			progress.Done()
+			progress.AddFile(fileName)
+		}(pageUrl)
 	}
 
 	return nil
@@ -134,22 +202,37 @@ func parsePage(filename string) (*CatalogItem, error) {
 
 	f, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, lib.FetchError(filename, lib.PageUrl(filename), err)
 	}
 	defer f.Close()
 
-	doc, err := goquery.NewDocumentFromReader(f)
+	return parseDocument(f, lib.PageUrl(filename), filename)
+}
+
+func parseDocument(r io.Reader, pageUrl string, filename string) (*CatalogItem, error) {
+
+	doc, err := goquery.NewDocumentFromReader(r)
 	if err != nil {
-		log.Fatal(err)
+		return nil, lib.DecodeError(filename, pageUrl, err)
 	}
 
+	base := lib.DocumentBase(pageUrl, doc, BaseUrl)
+
 	category := strings.TrimSpace(doc.Find("[itemprop=\"title\"]").Text())
 	if category != "Настольные компьютеры" {
-		return nil, nil
+		return nil, lib.NotProductError(filename, pageUrl, "category "+strconv.Quote(category))
 	}
 
-	item := new(CatalogItem)
+	item := &CatalogItem{Url: pageUrl}
 	item.Name = strings.TrimSpace(doc.Find(".title-big[itemprop=\"name\"]").Text())
+	if item.Name == "" {
+		return nil, lib.MissingFieldError(filename, pageUrl, "name")
+	}
+	item.Price = lib.ItemProp(doc, "price")
+	if availability := lib.ItemProp(doc, "availability"); availability != "" {
+		// http://schema.org/InStock -> InStock
+		item.Availability = path.Base(availability)
+	}
 	item.AttributeGroups = make([]*AttributeGroup, 0)
 	doc.Find(".b-product-card-tale table").Each(func(i1 int, s1 *goquery.Selection) {
 		group := new(AttributeGroup)
@@ -166,14 +249,50 @@ func parsePage(filename string) (*CatalogItem, error) {
 
 	item.Images = make([]*Image, 0)
 	doc.Find("img[itemprop=\"image\"]").Each(func(i1 int, s1 *goquery.Selection) {
+		src, _ := s1.Attr("src")
 		image := new(Image)
-		image.Url, _ = s1.Attr("src")
+		image.Url = lib.ResolveUrl(base, src)
+		if image.Url == "" {
+			return
+		}
 		item.Images = append(item.Images, image)
 	})
 	return item, nil
 }
 
-func parsePages() (error) {
+func toProduct(item *CatalogItem) (*lib.Product) {
+	product := &lib.Product{Site: Name, Url: item.Url, Aliases: item.Aliases, Name: item.Name, Price: item.Price, Availability: item.Availability}
+	for _, group := range item.AttributeGroups {
+		for _, attribute := range group.Attributes {
+			product.AddAttribute(group.Name, attribute.Key, attribute.Value)
+		}
+	}
+	for _, image := range item.Images {
+		product.Images = append(product.Images, image.Url)
+	}
+	return product
+}
+
+// ParseFile разбирает сохраненную страницу в общий формат товара.
+func ParseFile(filename string) (*lib.Product, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, lib.FetchError(filename, lib.PageUrl(filename), err)
+	}
+	defer f.Close()
+	return ParseReader(f, lib.PageUrl(filename), filename)
+}
+
+// ParseReader разбирает страницу из потока в общий формат товара.
+func ParseReader(r io.Reader, pageUrl string, name string) (*lib.Product, error) {
+	item, err := parseDocument(r, pageUrl, name)
+	if err != nil {
+		return nil, err
+	}
+	return toProduct(item), nil
+}
+
+func parsePages(ctx context.Context) (error) {
 
 	d, err := ioutil.ReadDir(PagesDataPath)
 	if err != nil {
@@ -183,24 +302,55 @@ func parsePages() (error) {
 	catalog := new(Catalog)
 	catalog.Items = make([]*CatalogItem, 0)
 
-	bar := pb.StartNew(len(d))
-	bar.SetWidth(80)
-	bar.ShowSpeed = true
-
+	report := lib.NewParseReport(Name, "parse", lib.RunOf(ctx))
+	stats := lib.NewFieldStats(Name, lib.RunOf(ctx))
+	duplicates := lib.NewDuplicateFilter()
+	progress := lib.NewProgress(Name, "parse", len(d))
+	defer progress.Finish()
 	for _, item := range d {
-		bar.Increment()
-		if item.IsDir() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if item.IsDir() || !lib.IsPageFile(item.Name()) {
+			progress.Done()
+			continue
+		}
+		fileName := PagesDataPath + item.Name()
+		progress.AddFile(fileName)
+		catalogItem, err := parsePage(fileName);
+		if lib.IsNotProduct(err) {
+			report.NotProduct(fileName)
+			progress.Done()
 			continue
 		}
-		catalogItem, err := parsePage(PagesDataPath + item.Name());
 		if err != nil {
-			log.Println(err)
+			report.Add(fileName, err)
+			lib.L(ctx).Warn("page not parsed", "file", fileName, "error", err)
+			progress.Fail()
+			continue
 		}
-		if catalogItem != nil {
-			catalog.Items = append(catalog.Items, catalogItem)
+		report.Ok()
+		progress.Done()
+		product := toProduct(catalogItem)
+		lib.CanonicalPage(Stream, product, fileName)
+		catalogItem.Url, catalogItem.Aliases = product.Url, product.Aliases
+		if first, i, ok := duplicates.Merge(product); ok {
+			catalog.Items[i].Aliases = first.Aliases
+			lib.L(ctx).Info("duplicate page merged", "file", fileName, "into", first.Url)
+			continue
 		}
+		stats.Add(product)
+		catalog.Items = append(catalog.Items, catalogItem)
 	}
 
+	lib.CheckRun(ctx, Health, stats, StatsPath)
+
+	if err := report.Quarantine(QuarantinePath); err != nil {
+		lib.L(ctx).Error("quarantine failed", "file", QuarantinePath, "error", err)
+	}
+	if err := report.Save(ErrorsPath); err != nil {
+		lib.L(ctx).Error("parse report not saved", "file", ErrorsPath, "error", err)
+	}
 	return saveCatalog(catalog, CatalogPath)
 }
 
@@ -210,15 +360,17 @@ func convertPages(directory string) (error) {
 		return err
 	}
 
-	for index, item := range d {
+	progress := lib.NewProgress(Name, "convert", len(d))
+	defer progress.Finish()
+	for _, item := range d {
+		progress.Done()
 		if item.IsDir() {
 			continue
 		}
 
-		log.Println(strconv.Itoa(index))
 		inputF, err := os.Open(directory + item.Name());
 		if err != nil {
-			log.Println(err)
+			lib.Log.Site(Name).Warn("page not converted", "file", directory+item.Name(), "error", err)
 		}
 
 		utfFile, err := iconv.NewReader(inputF, "windows-1251", "utf-8")
@@ -227,7 +379,7 @@ func convertPages(directory string) (error) {
 		}
 		outputF, err := os.Create(PagesDataPath + item.Name())
 		if err != nil {
-			log.Println(err)
+			lib.Log.Site(Name).Warn("page not converted", "file", PagesDataPath+item.Name(), "error", err)
 		}
 
 		io.Copy(outputF, utfFile)
@@ -238,33 +390,206 @@ func convertPages(directory string) (error) {
 	return nil;
 }
 
-func getImages() (error) {
+func getImages(ctx context.Context) (error) {
 	catalog, err := openCatalog(CatalogPath)
 	if err != nil {
 		return err
 	}
 
-	bar := pb.StartNew(len(catalog.Items)).Prefix("Image download")
-	bar.SetWidth(80)
-	bar.ShowSpeed = true
+	store, err := lib.NewImageStore(ImagesDataPath)
+	if err != nil {
+		return err
+	}
+
+	jobs := make([]*lib.ImageJob, 0)
+	targets := make([]*Image, 0)
 	for i, item := range catalog.Items {
-		bar.Increment()
 		for j, file := range item.Images {
-			imageFile := ImagesDataPath + "image-" + strconv.Itoa(i) + "-" + strconv.Itoa(j) + ".jpg"
-			err  = lib.DownloadAndSave(file.Url, imageFile, "")
-			if err == nil {
-				file.File = imageFile
+			jobs = append(jobs, &lib.ImageJob{Url: file.Url, Name: lib.ImageName("image-", i, j)})
+			targets = append(targets, file)
+		}
+	}
+
+	pool := lib.NewImagePool(store, ImageWorkers, ImageWorkersPerHost)
+	pool.Progress = lib.NewProgress(Name, "images", len(jobs))
+	for i, r := range pool.RunContext(ctx, jobs) {
+		if r.Err != nil {
+			lib.L(ctx).Warn("image download failed", "url", r.Job.Url, "error", r.Err)
+			continue
+		}
+		targets[i].File = ImagesDataPath + r.File
+		targets[i].ImageInfo = *r.Info
+	}
+	pool.Progress.Finish()
+	// При отмене сохраняем то, что успели скачать
+	if err := saveCatalog(catalog, ImagedCatalogPath); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// findPlaceholders ищет картинки, общие для многих товаров, и помечает
+// заглушки "нет фото" в каталоге с картинками.
+func findPlaceholders(ctx context.Context) (error) {
+	catalog, err := openCatalog(ImagedCatalogPath)
+	if err != nil {
+		return err
+	}
+	blacklist, err := lib.OpenPlaceholders(PlaceholdersPath)
+	if err != nil {
+		return err
+	}
+
+	refs := make([]*lib.ImageRef, 0)
+	for i, item := range catalog.Items {
+		product := strconv.Itoa(i) + " " + item.Name
+		for _, image := range item.Images {
+			if image.File != "" {
+				refs = append(refs, &lib.ImageRef{Product: product, File: image.File, DHash: image.DHash, Info: &image.ImageInfo})
 			}
 		}
 	}
-	bar.Finish()
+
+	report := lib.FindSharedImages(Name, refs, blacklist, lib.DefaultSharedImageOptions)
+	lib.L(ctx).Info("shared images found", "clusters", len(report.Clusters), "onlyPlaceholders", len(report.OnlyPlaceholders))
+	if err := lib.SavePlaceholders(blacklist, PlaceholdersPath); err != nil {
+		return err
+	}
+	if err := lib.SaveSharedImagesReport(report, SharedImagesPath); err != nil {
+		return err
+	}
 	return saveCatalog(catalog, ImagedCatalogPath)
 }
 
-func Run() (error) {
-	//return getSiteMap();
-	//return getPages()
+// makeVariants строит уменьшенные копии скачанных картинок для маркетплейсов.
+func makeVariants(ctx context.Context) (error) {
+	catalog, err := openCatalog(ImagedCatalogPath)
+	if err != nil {
+		return err
+	}
+	variants, err := lib.LoadVariants(VariantsConfigPath)
+	if err != nil {
+		return err
+	}
+
+	done := make(map[string][]*lib.ImageVariant)
+	progress := lib.NewProgress(Name, "variants", len(catalog.Items))
+	for _, item := range catalog.Items {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.Done()
+		for _, image := range item.Images {
+			if image.File == "" {
+				continue
+			}
+			if v, ok := done[image.File]; ok {
+				image.Variants = v
+				continue
+			}
+			image.Variants, err = lib.MakeVariants(image.File, VariantsPath, variants)
+			if err != nil {
+				lib.L(ctx).Warn("image variants failed", "file", image.File, "error", err)
+				continue
+			}
+			done[image.File] = image.Variants
+		}
+	}
+	progress.Finish()
+	if err := saveCatalog(catalog, ImagedCatalogPath); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+var Stages = []*lib.Stage{
+	{Name: "sitemap", Run: getSiteMap},
+	{Name: "pages", Run: getPages},
+	{Name: "parse", Run: parsePages},
+	{Name: "images", Run: getImages},
+	{Name: "placeholders", Run: findPlaceholders},
+	{Name: "variants", Run: makeVariants},
+}
+
+// RunStream качает, разбирает и сохраняет товары одним потоком, без
+// промежуточных файлов. С keepPages сырые страницы тоже сохраняются.
+func RunStream(ctx context.Context, keepPages bool) (error) {
+	config := lib.DefaultPipelineConfig
+	if keepPages {
+		config.PagesDir = PagesDataPath
+	}
+	store, err := lib.NewImageStore(ImagesDataPath)
+	if err != nil {
+		return err
+	}
+	config.Images = store
+	return lib.RunStream(ctx, Stream, config, ProductsPath, ErrorsPath, Health, StatsPath)
+}
+
+// Regions добавляет к товарам потокового режима цены и наличие по
+// регионам из RegionsPath.
+func Regions(ctx context.Context) (error) {
+	return lib.RunRegions(ctx, Stream, RegionsPath, ProductsPath)
+}
+
+// Coordinate раздает обход сайта воркерам, см. lib.RunCoordinator.
+func Coordinate(ctx context.Context, listen string) (error) {
+	return lib.RunCoordinator(ctx, Stream, listen, ProductsPath, StatePath, ErrorsPath, Health, StatsPath)
+}
+
+func Run(ctx context.Context) (error) {
+	//return getSiteMap(ctx);
+	//return getPages(ctx)
 	//convertPages()
-	//return parsePages()
-	return getImages()
+	//return parsePages(ctx)
+	return getImages(ctx)
+	//return findPlaceholders(ctx)
+	//return makeVariants(ctx)
+}
+
+// Products возвращает товары последнего прогона: из потокового режима
+// или из каталога стадий, смотря что новее.
+func Products() ([]*lib.Product, error) {
+	filename, err := latestFile()
+	if err != nil {
+		return nil, err
+	}
+	return Open(filename)
+}
+
+func latestFile() (string, error) {
+	return lib.LatestFile(ProductsPath, ImagedCatalogPath, CatalogPath)
+}
+
+// History дописывает цены и наличие последнего прогона в HistoryPath,
+// если товары обновились после since.
+func History(ctx context.Context, since time.Time) (error) {
+	filename, err := latestFile()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return lib.RecordHistory(ctx, HistoryPath, filename, since, Open)
+}
+
+// Open читает товары из файла потокового режима или из каталога сайта.
+func Open(filename string) ([]*lib.Product, error) {
+	isProducts, err := lib.IsProductsFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if isProducts {
+		return lib.OpenProducts(filename)
+	}
+	catalog, err := openCatalog(filename)
+	if err != nil {
+		return nil, err
+	}
+	products := make([]*lib.Product, 0, len(catalog.Items))
+	for _, item := range catalog.Items {
+		products = append(products, toProduct(item))
+	}
+	return products, nil
 }
@@ -0,0 +1,8 @@
+package compyou
+
+import (
+	"testing"
+	lib "goods.ru/grab-it/libs"
+)
+
+func TestGolden(t *testing.T) { lib.TestGolden(t, FixturesPath, ParseFile) }
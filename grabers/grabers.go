@@ -0,0 +1,135 @@
+package grabers
+
+import (
+	"context"
+	"fmt"
+	"goods.ru/grab-it/grabers/autofanatik"
+	"goods.ru/grab-it/grabers/compyou"
+	"goods.ru/grab-it/grabers/vseinstrumenty"
+	lib "goods.ru/grab-it/libs"
+	"sort"
+	"time"
+)
+
+type Site struct {
+	Name       string
+	Charset    string
+	Fixtures   string
+	ParseFile  lib.ParseFunc
+	Health     *lib.HealthRules
+	CanaryUrls string
+	CanaryPath string
+	Stages     []*lib.Stage
+	Stream     func(ctx context.Context, keepPages bool) error
+	Source     *lib.StreamSource
+	Coordinate func(ctx context.Context, listen string) error
+	Products   func() ([]*lib.Product, error)
+	Open       func(filename string) ([]*lib.Product, error)
+	ErrorsPath string
+	StatsPath  string
+	Profile    string
+	Regions    func(ctx context.Context) error
+	Record     func(ctx context.Context, since time.Time) error
+	History    string
+}
+
+var Sites = map[string]*Site{
+	autofanatik.Name: {
+		Name:       autofanatik.Name,
+		Fixtures:   autofanatik.FixturesPath,
+		ParseFile:  autofanatik.ParseFile,
+		Health:     autofanatik.Health,
+		CanaryUrls: autofanatik.CanaryUrlsPath,
+		CanaryPath: autofanatik.CanaryPath,
+		Stages:     autofanatik.Stages,
+		Stream:     autofanatik.RunStream,
+		Source:     autofanatik.Stream,
+		Coordinate: autofanatik.Coordinate,
+		Products:   autofanatik.Products,
+		Open:       autofanatik.Open,
+		ErrorsPath: autofanatik.ErrorsPath,
+		StatsPath:  autofanatik.StatsPath,
+		Profile:    autofanatik.ProfilePath,
+		Regions:    autofanatik.Regions,
+		Record:     autofanatik.History,
+		History:    autofanatik.HistoryPath,
+	},
+	compyou.Name: {
+		Name:       compyou.Name,
+		Charset:    compyou.Charset,
+		Fixtures:   compyou.FixturesPath,
+		ParseFile:  compyou.ParseFile,
+		Health:     compyou.Health,
+		CanaryUrls: compyou.CanaryUrlsPath,
+		CanaryPath: compyou.CanaryPath,
+		Stages:     compyou.Stages,
+		Stream:     compyou.RunStream,
+		Source:     compyou.Stream,
+		Coordinate: compyou.Coordinate,
+		Products:   compyou.Products,
+		Open:       compyou.Open,
+		ErrorsPath: compyou.ErrorsPath,
+		StatsPath:  compyou.StatsPath,
+		Profile:    compyou.ProfilePath,
+		Regions:    compyou.Regions,
+		Record:     compyou.History,
+		History:    compyou.HistoryPath,
+	},
+	vseinstrumenty.Name: {
+		Name:       vseinstrumenty.Name,
+		Fixtures:   vseinstrumenty.FixturesPath,
+		ParseFile:  vseinstrumenty.ParseFile,
+		Health:     vseinstrumenty.Health,
+		CanaryUrls: vseinstrumenty.CanaryUrlsPath,
+		CanaryPath: vseinstrumenty.CanaryPath,
+		Stages:     vseinstrumenty.Stages,
+		Stream:     vseinstrumenty.RunStream,
+		Source:     vseinstrumenty.Stream,
+		Coordinate: vseinstrumenty.Coordinate,
+		Products:   vseinstrumenty.Products,
+		Open:       vseinstrumenty.Open,
+		ErrorsPath: vseinstrumenty.ErrorsPath,
+		StatsPath:  vseinstrumenty.StatsPath,
+		Profile:    vseinstrumenty.ProfilePath,
+		Regions:    vseinstrumenty.Regions,
+		Record:     vseinstrumenty.History,
+		History:    vseinstrumenty.HistoryPath,
+	},
+}
+
+// Session готовит запросы сайта по его профилю (заголовки, куки, шаги
+// перед обходом). done сохраняет куки, его зовут в конце запуска.
+func (s *Site) Session(ctx context.Context) (context.Context, func(), error) {
+	return lib.StartSession(ctx, s.Name, s.Profile)
+}
+
+func Get(name string) (*Site, error) {
+	site, ok := Sites[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown site %q", name)
+	}
+	return site, nil
+}
+
+// Select возвращает один сайт по имени или все сайты, если имя пустое.
+func Select(name string) ([]*Site, error) {
+	if name != "" {
+		site, err := Get(name)
+		if err != nil {
+			return nil, err
+		}
+		return []*Site{site}, nil
+	}
+
+	names := make([]string, 0, len(Sites))
+	for n := range Sites {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	sites := make([]*Site, 0, len(names))
+	for _, n := range names {
+		sites = append(sites, Sites[n])
+	}
+	return sites, nil
+}
@@ -2,29 +2,66 @@ package vseinstrumenty
 
 import (
 	"bufio"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"io"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	lib "goods.ru/grab-it/libs"
 )
 
 const (
+	Name       = "vseinstrumenty"
 	DataPath   = "grabers/vseinstrumenty/data/"
 	SiteMapURL = "http://www.vseinstrumenti.ru/sitemap.xml"
 	FilesCount = 13
 	Template1  = "http://www.vseinstrumenti.ru/instrument/shurupoverty/"
 	Template2  = "http://www.vseinstrumenti.ru/instrument/perforatory/"
 	Template3  = "http://www.vseinstrumenti.ru/instrument/dreli/"
+	// Наличие и доставку страница подгружает скриптом по id товара
+	StockURL = "http://www.vseinstrumenti.ru/ajax/product/stock/?id="
+	// Заголовок карточки (#card-h1-reload-new) страница перезагружает скриптом
+	HeaderURL = "http://www.vseinstrumenti.ru/ajax/product/header/?id="
+
+	QuarantinePath = DataPath + "quarantine/"
+	ErrorsPath     = DataPath + "/errors.xml"
+	StatsPath      = DataPath + "/fieldstats.xml"
+	CanaryPath     = DataPath + "/canary.xml"
+	CanaryUrlsPath = DataPath + "/canary.txt"
+	PagesDataPath  = DataPath + "pages/"
+	ProductsPath   = DataPath + "/products.xml"
+	CatalogPath    = DataPath + "/catalog.xml"
+	StatePath      = DataPath + "/crawl-state.json"
+	ProfilePath    = DataPath + "/profile.json"
+	RegionsPath    = DataPath + "/regions.json"
+	HistoryPath    = DataPath + "/history.csv"
 )
 
+var Stream = &lib.StreamSource{
+	Site:       Name,
+	SiteMapUrl: SiteMapURL,
+	Filter:     isProductUrl,
+	Parse:      ParseReader,
+	// Товар - путь с косой чертой в конце, к регистру сайт не чувствителен
+	Canonical: &lib.CanonicalRules{StripParams: []string{"*"}, LowerPath: true, TrailingSlash: lib.TrailingSlashAdd},
+}
+
+// Сохраненные страницы и эталоны для golden
+var FixturesPath = lib.FixturesDir()
+
+var Health = &lib.HealthRules{
+	Required: []string{"name", "attributes"},
+	MinRate:  map[string]float64{"shortName": 0.9, "description": 0.5},
+	MaxDrop:  0.2,
+}
+
 type CatalogItemMeasure struct {
 	XMLName xml.Name `xml:"measurement"`
 	Key     string   `xml:"key"`
@@ -39,9 +76,15 @@ type CatalogItemAttribute struct {
 
 type CatalogItem struct {
 	XMLName      xml.Name                `xml:"catalogItem"`
+	Id           string                  `xml:"id,omitempty"`
+	Url          string                  `xml:"url,omitempty"`
+	Aliases      []string                `xml:"alias,omitempty"`
 	Name         string                  `xml:"name"`
 	ShortName    string                  `xml:"shortName"`
 	Description  string                  `xml:"description"`
+	Price        string                  `xml:"price,omitempty"`
+	Availability string                  `xml:"availability,omitempty"`
+	Delivery     string                  `xml:"delivery,omitempty"`
 	Attributes   []*CatalogItemAttribute `xml:"attributes>attribute"`
 	Equipment    []string                `xml:"equipments>equipment"`
 	Measurements []*CatalogItemMeasure   `xml:"measurements>measurement"`
@@ -49,7 +92,7 @@ type CatalogItem struct {
 
 type Catalog struct {
 	XMLName xml.Name       `xml:"catalog"`
-	Items   []*CatalogItem `xml:"items"`
+	Items   []*CatalogItem `xml:"catalogItem"`
 }
 
 type SiteMapItem struct {
@@ -99,65 +142,70 @@ func writeLines(lines []string, path string) error {
 	return w.Flush()
 }
 
-func downloadAndSaveXML(url string, fileIndex string, wg *sync.WaitGroup) {
-
-	defer wg.Done()
-
-	client := http.Client{Timeout: 10 * time.Second}
-	res, err := client.Get(url)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer res.Body.Close()
+func downloadAndSaveXML(ctx context.Context, url string, fileIndex string) (error) {
 
 	fileName := fileIndex + ".xml"
-
-	f, err := os.Create(DataPath + fileName)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-
-	io.Copy(f, res.Body)
-	log.Println(fileName)
+	return lib.DownloadAndSaveContext(ctx, url, DataPath+fileName, "")
 }
 
-func StepOne() {
+func StepOne(ctx context.Context) (error) {
 
-	client := http.Client{Timeout: 10 * time.Second}
-	res, err := client.Get(SiteMapURL)
+	res, cancel, err := lib.Get(ctx, SiteMapURL)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer cancel()
 	defer res.Body.Close()
 
 	siteMap := new(SiteMapIndex)
-	xml.NewDecoder(res.Body).Decode(siteMap)
+	if err := xml.NewDecoder(res.Body).Decode(siteMap); err != nil {
+		return err
+	}
 
 	f, err := os.Create(DataPath + "/sitemap.xml")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer f.Close()
 
 	xml.NewEncoder(f).Encode(siteMap)
 
+	progress := lib.NewProgress(Name, "sitemap", len(siteMap.Maps))
+	defer progress.Finish()
+
 	var wg sync.WaitGroup
+	errs := make(chan error, len(siteMap.Maps))
 	for index, url := range siteMap.Maps {
 		fileIndex := strconv.Itoa(index)
-		log.Println(fileIndex + ":" + url.Url)
 		wg.Add(1)
-		go downloadAndSaveXML(url.Url, fileIndex, &wg)
+		go func(url string) {
+			defer wg.Done()
+			if err := downloadAndSaveXML(ctx, url, fileIndex); err != nil {
+				progress.Fail()
+				errs <- err
+				return
+			}
+			progress.Done()
+			progress.AddFile(DataPath + fileIndex + ".xml")
+		}(url.Url)
 	}
 	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+type linksResult struct {
+	links []string
+	err   error
 }
 
-func getLinks(fileIndex int, c chan []string) {
+func getLinks(fileIndex int, c chan linksResult) {
 
 	links := make([]string, 0)
 	f, err := os.Open(DataPath + strconv.Itoa(fileIndex) + ".xml")
 	if err != nil {
-		log.Fatal(err)
+		c <- linksResult{err: err}
+		return
 	}
 	defer f.Close()
 
@@ -165,139 +213,402 @@ func getLinks(fileIndex int, c chan []string) {
 	xml.NewDecoder(f).Decode(urlset)
 
 	for _, url := range urlset.Urls {
-		if strings.Contains(url.Url, Template1) ||
-			strings.Contains(url.Url, Template2) ||
-			strings.Contains(url.Url, Template3) {
+		if isProductUrl(url.Url) {
 			links = append(links, url.Url)
 		}
 	}
 
-	c <- links
+	c <- linksResult{links: links}
 
 }
 
-func StepTwo() {
-	c := make(chan []string)
+func isProductUrl(url string) (bool) {
+	return strings.Contains(url, Template1) ||
+		strings.Contains(url, Template2) ||
+		strings.Contains(url, Template3)
+}
+
+func StepTwo(ctx context.Context) (error) {
+	c := make(chan linksResult, FilesCount)
 	for i := 1; i <= FilesCount; i++ {
 		go getLinks(i, c)
 	}
 
+	var first error
 	links := make([]string, 0)
 	for i := 1; i <= FilesCount; i++ {
-		for _, link := range <-c {
+		r := <-c
+		if r.err != nil && first == nil {
+			first = r.err
+		}
+		for _, link := range r.links {
 			links = append(links, link)
 		}
 	}
-	close(c)
-	writeLines(links, DataPath+"/links.txt")
+	if first != nil {
+		return first
+	}
+	// Один товар бывает в карте сайта под несколькими адресами
+	return writeLines(lib.CanonicalUrls(links, Stream.Canonical), DataPath+"/links.txt")
 }
 
-func getAndSavePage(url string, fileName string) {
-	client := http.Client{Timeout: 10 * time.Second}
+func getAndSavePage(ctx context.Context, url string, fileName string) (error) {
+	return lib.DownloadPageContext(ctx, url, DataPath+"/pages/"+fileName, "")
+}
 
-	res, err := client.Get(url)
+func StepThree(ctx context.Context) (error) {
+	links, err := readLines(DataPath + "/links.txt")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer res.Body.Close()
 
-	f, err := os.Create(DataPath + "/pages/" + fileName)
+	progress := lib.NewProgress(Name, "pages", len(links))
+	defer progress.Finish()
+	for index, url := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fileName := strconv.Itoa(index) + ".html"
+		if err := getAndSavePage(ctx, url, fileName); err != nil {
+			lib.L(ctx).Warn("page download failed", "url", url, "file", fileName, "error", err)
+			progress.Fail()
+			continue
+		}
+		progress.Done()
+		progress.AddFile(DataPath + "/pages/" + fileName)
+	}
+	return nil
+}
+
+func parsePage(filename string) (*CatalogItem, error) {
+
+	f, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, lib.FetchError(filename, lib.PageUrl(filename), err)
 	}
 	defer f.Close()
-	io.Copy(f, res.Body)
-	log.Println(fileName + ": " + url)
+
+	return parseDocument(f, lib.PageUrl(filename), filename)
 }
 
-func StepThree() {
-	links, err := readLines(DataPath + "/links.txt")
+func parseDocument(r io.Reader, pageUrl string, filename string) (*CatalogItem, error) {
+
+	doc, err := goquery.NewDocumentFromReader(r)
 	if err != nil {
-		log.Fatal(err)
+		return nil, lib.DecodeError(filename, pageUrl, err)
 	}
 
-	for index, url := range links {
-		getAndSavePage(url, strconv.Itoa(index)+".html")
+	chars := doc.Find("#allCharacteristics .thValueBlock")
+	if len(chars.Nodes) == 0 {
+		return nil, lib.NotProductError(filename, pageUrl, "no #allCharacteristics block")
+	}
+
+	item := &CatalogItem{Url: pageUrl}
+
+	item.Id, _ = doc.Find("[data-product-id]").First().Attr("data-product-id")
+	item.Id = strings.TrimSpace(item.Id)
+
+	// Без заголовка в html имя придет запросом HeaderURL, если есть id
+	item.Name = strings.TrimSpace(strings.Replace(doc.Find("#card-h1-reload-new").Text(), "\n", "", -1))
+	if item.Name == "" && item.Id == "" {
+		return nil, lib.MissingFieldError(filename, pageUrl, "name")
+	}
+	item.Description = strings.TrimSpace(strings.Replace(doc.Find("[itemprop=\"description\"] p").Text(), "\n", "", -1))
+	item.ShortName = strings.TrimSpace(strings.Replace(strings.Replace(doc.Find("#cardVendorSclonenie13").Text(), "\n", "", -1), "Технические характеристики", "", -1))
+
+	// Цена и наличие зависят от региона, см. Regions
+	item.Price = lib.ItemProp(doc, "price")
+	if availability := lib.ItemProp(doc, "availability"); availability != "" {
+		// http://schema.org/InStock -> InStock
+		item.Availability = path.Base(availability)
 	}
 
+	chars.Each(func(i1 int, s1 *goquery.Selection) {
+		attribute := new(CatalogItemAttribute)
+		attribute.Key = s1.Find(".thName").Text()
+		attribute.Value = s1.Find(".thValue").Text()
+		item.Attributes = append(item.Attributes, attribute)
+	})
+
+	measures := strings.Replace(strings.Replace(doc.Find("#vgh-block div").Text(), "\n", "", 1), "\n", "#", 2)
+	measureList := strings.Split(measures, "#")
+	for _, m := range measureList {
+		measure := new(CatalogItemMeasure)
+		m0 := strings.Split(m, ":")
+		measure.Key = strings.Replace(m0[0], "\n", "", -1)
+		if len(m0) > 1 {
+			measure.Value = strings.Replace(m0[1], "\n", "", -1)
+		} else {
+			measure.Value = ""
+		}
+		item.Measurements = append(item.Measurements, measure)
+	}
+
+	doc.Find(".complect li").Each(func(i1 int, s1 *goquery.Selection) {
+		item.Equipment = append(item.Equipment, s1.Text())
+	})
+
+	return item, nil
 }
 
-func StepFour() {
+func toProduct(item *CatalogItem) (*lib.Product) {
+	product := &lib.Product{
+		Site:         Name,
+		Url:          item.Url,
+		Aliases:      item.Aliases,
+		Name:         item.Name,
+		ShortName:    item.ShortName,
+		Description:  item.Description,
+		Price:        item.Price,
+		Availability: item.Availability,
+	}
+	for _, attribute := range item.Attributes {
+		product.AddAttribute("", attribute.Key, attribute.Value)
+	}
+	for _, measure := range item.Measurements {
+		product.AddAttribute("measurements", measure.Key, measure.Value)
+	}
+	for _, equipment := range item.Equipment {
+		product.AddAttribute("equipment", equipment, "")
+	}
+	if item.Delivery != "" {
+		product.AddAttribute("delivery", "Доставка", item.Delivery)
+	}
+	return product
+}
+
+// ParseFile разбирает сохраненную страницу в общий формат товара.
+func ParseFile(filename string) (*lib.Product, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, lib.FetchError(filename, lib.PageUrl(filename), err)
+	}
+	defer f.Close()
+	return ParseReader(f, lib.PageUrl(filename), filename)
+}
+
+// ParseReader разбирает страницу из потока в общий формат товара.
+func ParseReader(r io.Reader, pageUrl string, name string) (*lib.Product, error) {
+	item, err := parseDocument(r, pageUrl, name)
+	if err != nil {
+		return nil, err
+	}
+	product := toProduct(item)
+	addFollowUps(product, item)
+	return product, nil
+}
+
+// stockResponse - ответ StockURL.
+type stockResponse struct {
+	Availability string `json:"availability"`
+	Delivery     string `json:"delivery"`
+}
+
+// headerResponse - ответ HeaderURL.
+type headerResponse struct {
+	Name string `json:"name"`
+}
+
+// addFollowUps добавляет к товару запросы наличия и заголовка по id со
+// страницы. Ответы попадают и в запись каталога item, и в товар.
+func addFollowUps(product *lib.Product, item *CatalogItem) {
+	if item.Id == "" {
+		return
+	}
+	product.AddFollowUp("header", HeaderURL+item.Id, lib.MergeJSON(func() (interface{}) { return new(headerResponse) }, func(p *lib.Product, v interface{}) {
+		mergeHeader(item, v.(*headerResponse))
+		p.Name = item.Name
+	}))
+	product.AddFollowUp("stock", StockURL+item.Id, lib.MergeJSON(func() (interface{}) { return new(stockResponse) }, func(p *lib.Product, v interface{}) {
+		mergeStock(item, v.(*stockResponse))
+		p.Availability = item.Availability
+		if item.Delivery != "" {
+			p.AddAttribute("delivery", "Доставка", item.Delivery)
+		}
+	}))
+}
+
+// mergeHeader - перезагруженный заголовок новее того, что в html.
+func mergeHeader(item *CatalogItem, header *headerResponse) {
+	if name := strings.TrimSpace(header.Name); name != "" {
+		item.Name = name
+	}
+}
+
+// mergeStock - наличие из скрипта точнее микроразметки, она бывает закеширована.
+func mergeStock(item *CatalogItem, stock *stockResponse) {
+	if stock.Availability != "" {
+		item.Availability = path.Base(stock.Availability)
+	}
+	if stock.Delivery != "" {
+		item.Delivery = stock.Delivery
+	}
+}
+
+func StepFour(ctx context.Context) (error) {
 
 	catalog := new(Catalog)
 
 	files, err := ioutil.ReadDir(DataPath + "/pages")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
+	report := lib.NewParseReport(Name, "StepFour", lib.RunOf(ctx))
+	stats := lib.NewFieldStats(Name, lib.RunOf(ctx))
+	duplicates := lib.NewDuplicateFilter()
+	// Наличие и заголовок, как в потоковом режиме, в общем лимите сайта
+	followUps := lib.NewFollowUpFetcher(Name, lib.SiteLimit(Name, 0), PagesDataPath)
+	progress := lib.NewProgress(Name, "parse", len(files))
+	defer progress.Finish()
 	for _, file := range files {
-		log.Println(file.Name())
-
-		f, err := os.Open(DataPath + "/pages/" + file.Name())
-		if err != nil {
-			log.Fatal(err)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !lib.IsPageFile(file.Name()) {
+			progress.Done()
+			continue
 		}
-		defer f.Close()
 
-		doc, err := goquery.NewDocumentFromReader(f)
+		fileName := DataPath + "/pages/" + file.Name()
+		progress.AddFile(fileName)
+		item, err := parsePage(fileName)
+		if lib.IsNotProduct(err) {
+			report.NotProduct(fileName)
+			progress.Done()
+			continue
+		}
 		if err != nil {
-			log.Fatal(err)
+			report.Add(fileName, err)
+			lib.L(ctx).Warn("page not parsed", "file", fileName, "error", err)
+			progress.Fail()
+			continue
 		}
-
-		chars := doc.Find("#allCharacteristics .thValueBlock")
-		if len(chars.Nodes) == 0 {
+		report.Ok()
+		progress.Done()
+		product := toProduct(item)
+		lib.CanonicalPage(Stream, product, fileName)
+		item.Url, item.Aliases = product.Url, product.Aliases
+		// Имя может прийти только запросом заголовка, а без него дубли по
+		// содержимому не найти, поэтому запросы - до склейки
+		addFollowUps(product, item)
+		followUps.Run(ctx, product)
+		if first, i, ok := duplicates.Merge(product); ok {
+			catalog.Items[i].Aliases = first.Aliases
+			lib.L(ctx).Info("duplicate page merged", "file", fileName, "into", first.Url)
 			continue
 		}
+		stats.Add(product)
 
-		item := new(CatalogItem)
-
-		item.Name = strings.TrimSpace(strings.Replace(doc.Find("#card-h1-reload-new").Text(), "\n", "", -1))
-		item.Description = strings.TrimSpace(strings.Replace(doc.Find("[itemprop=\"description\"] p").Text(), "\n", "", -1))
-		item.ShortName = strings.TrimSpace(strings.Replace(strings.Replace(doc.Find("#cardVendorSclonenie13").Text(), "\n", "", -1), "Технические характеристики", "", -1))
-
-		chars.Each(func(i1 int, s1 *goquery.Selection) {
-			attribute := new(CatalogItemAttribute)
-			attribute.Key = s1.Find(".thName").Text()
-			attribute.Value = s1.Find(".thValue").Text()
-			item.Attributes = append(item.Attributes, attribute)
-		})
-
-		measures := strings.Replace(strings.Replace(doc.Find("#vgh-block div").Text(), "\n", "", 1), "\n", "#", 2)
-		measureList := strings.Split(measures, "#")
-		for _, m := range measureList {
-			measure := new(CatalogItemMeasure)
-			m0 := strings.Split(m, ":")
-			measure.Key = strings.Replace(m0[0], "\n", "", -1)
-			if len(m0) > 1 {
-				measure.Value = strings.Replace(m0[1], "\n", "", -1)
-			} else {
-				measure.Value = ""
-			}
-			item.Measurements = append(item.Measurements, measure)
-		}
+		catalog.Items = append(catalog.Items, item)
+	}
 
-		doc.Find(".complect li").Each(func(i1 int, s1 *goquery.Selection) {
-			item.Equipment = append(item.Equipment, s1.Text())
-		})
+	lib.CheckRun(ctx, Health, stats, StatsPath)
 
-		catalog.Items = append(catalog.Items, item)
+	if err := report.Quarantine(QuarantinePath); err != nil {
+		lib.L(ctx).Error("quarantine failed", "file", QuarantinePath, "error", err)
+	}
+	if err := report.Save(ErrorsPath); err != nil {
+		lib.L(ctx).Error("parse report not saved", "file", ErrorsPath, "error", err)
+	}
+
+	rf, err := os.Create(CatalogPath)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+
+	return xml.NewEncoder(rf).Encode(catalog)
+}
+
+var Stages = []*lib.Stage{
+	{Name: "sitemap", Run: StepOne},
+	{Name: "links", Run: StepTwo},
+	{Name: "pages", Run: StepThree},
+	{Name: "parse", Run: StepFour},
+}
+
+// RunStream качает, разбирает и сохраняет товары одним потоком, без
+// промежуточных файлов. С keepPages сырые страницы тоже сохраняются.
+func RunStream(ctx context.Context, keepPages bool) (error) {
+	config := lib.DefaultPipelineConfig
+	if keepPages {
+		config.PagesDir = PagesDataPath
 	}
+	return lib.RunStream(ctx, Stream, config, ProductsPath, ErrorsPath, Health, StatsPath)
+}
+
+// Regions добавляет к товарам потокового режима цены и наличие по
+// регионам из RegionsPath.
+func Regions(ctx context.Context) (error) {
+	return lib.RunRegions(ctx, Stream, RegionsPath, ProductsPath)
+}
+
+// Coordinate раздает обход сайта воркерам, см. lib.RunCoordinator.
+func Coordinate(ctx context.Context, listen string) (error) {
+	return lib.RunCoordinator(ctx, Stream, listen, ProductsPath, StatePath, ErrorsPath, Health, StatsPath)
+}
 
-	rf, err := os.Create(DataPath + "/catalog.xml")
+func Run(ctx context.Context) (error) {
+	return lib.RunStages(ctx, Name, Stages, nil)
+}
+
+func openCatalog(filename string) (*Catalog, error) {
+	catalog := new(Catalog)
+	rf, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rf.Close()
+	if err := xml.NewDecoder(rf).Decode(catalog); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
 
-	xml.NewEncoder(rf).Encode(catalog)
+// Products возвращает товары последнего прогона: из потокового режима
+// или из каталога стадий, смотря что новее.
+func Products() ([]*lib.Product, error) {
+	filename, err := latestFile()
+	if err != nil {
+		return nil, err
+	}
+	return Open(filename)
+}
+
+func latestFile() (string, error) {
+	return lib.LatestFile(ProductsPath, CatalogPath)
+}
+
+// History дописывает цены и наличие последнего прогона в HistoryPath,
+// если товары обновились после since.
+func History(ctx context.Context, since time.Time) (error) {
+	filename, err := latestFile()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return lib.RecordHistory(ctx, HistoryPath, filename, since, Open)
 }
 
-func Run() {
-	log.Println("Start")
-	StepOne()
-	StepTwo()
-	StepThree()
-	StepFour()
-	log.Println("Finish")
+// Open читает товары из файла потокового режима или из каталога сайта.
+func Open(filename string) ([]*lib.Product, error) {
+	isProducts, err := lib.IsProductsFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if isProducts {
+		return lib.OpenProducts(filename)
+	}
+	catalog, err := openCatalog(filename)
+	if err != nil {
+		return nil, err
+	}
+	products := make([]*lib.Product, 0, len(catalog.Items))
+	for _, item := range catalog.Items {
+		products = append(products, toProduct(item))
+	}
+	return products, nil
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"goods.ru/grab-it/grabers"
+	lib "goods.ru/grab-it/libs"
+)
+
+// historyCommand выгружает историю цен сайта в csv: ряд одного товара,
+// сводку min/max/avg за окно или товары с самым сильным изменением цены.
+func historyCommand(ctx context.Context, args []string) (error) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	siteName := flags.String("site", "", "site whose history to query")
+	product := flags.String("product", "", "product url, article, name or full key (url:...)")
+	stats := flags.Bool("stats", false, "min, max and avg price per product instead of raw observations")
+	movers := flags.Int("movers", 0, "this many products with the biggest price change, in percent")
+	from := flags.String("from", "", "window start, 2006-01-02 or RFC3339")
+	to := flags.String("to", "", "window end, 2006-01-02 or RFC3339")
+	days := flags.Int("days", 0, "window of the last days, instead of -from")
+	output := flags.String("o", "", "write csv to this file instead of stdout")
+	flags.Parse(args)
+
+	if *siteName == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	site, err := grabers.Get(*siteName)
+	if err != nil {
+		return err
+	}
+
+	fromTime, err := parseWindowTime(*from, false)
+	if err != nil {
+		return fmt.Errorf("-from: %v", err)
+	}
+	toTime, err := parseWindowTime(*to, true)
+	if err != nil {
+		return fmt.Errorf("-to: %v", err)
+	}
+	if *days > 0 {
+		fromTime = time.Now().AddDate(0, 0, -*days)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	store := lib.OpenHistory(site.History)
+	if *movers > 0 {
+		result, err := store.Movers(fromTime, toTime, *movers)
+		if err != nil {
+			return err
+		}
+		return lib.WriteStatsCSV(w, result)
+	}
+
+	var match func(o *lib.Observation) (bool)
+	if *product != "" {
+		match = lib.MatchProduct(*product)
+	}
+	observations, err := store.Read(fromTime, toTime, match)
+	if err != nil {
+		return err
+	}
+	if *stats {
+		return lib.WriteStatsCSV(w, lib.ProductStats(observations))
+	}
+	return lib.WriteObservationsCSV(w, observations)
+}
+
+// parseWindowTime: дата без времени в -to означает конец этого дня.
+func parseWindowTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
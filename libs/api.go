@@ -0,0 +1,458 @@
+package libs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APISite - сайт, которым можно управлять через ControlAPI.
+type APISite struct {
+	Name string
+	Run  RunFunc
+	// Имена стадий, чтобы проверить запрос до запуска
+	Stages     []string
+	Products   func() ([]*Product, error)
+	ErrorsPath string
+	StatsPath  string
+}
+
+// ControlAPI - http api режима serve: запуск и отмена обходов, история
+// запусков с прогрессом, отчеты и товары последнего каталога.
+type ControlAPI struct {
+	Scheduler *Scheduler
+	Sites     map[string]*APISite
+	// Сколько держать разобранный каталог в памяти между страницами
+	CacheTTL time.Duration
+
+	// Запуски через api живут, пока жив ctx, а не запрос
+	ctx   context.Context
+	m     sync.Mutex
+	cache map[string]*productsCache
+}
+
+type productsCache struct {
+	loaded   time.Time
+	products []*Product
+}
+
+func NewControlAPI(ctx context.Context, scheduler *Scheduler, sites []*APISite) (*ControlAPI) {
+	api := &ControlAPI{Scheduler: scheduler, Sites: make(map[string]*APISite), CacheTTL: 5 * time.Minute, ctx: ctx, cache: make(map[string]*productsCache)}
+	for _, site := range sites {
+		api.Sites[site.Name] = site
+	}
+	return api
+}
+
+// SiteStatus - сайт в списке GET /sites.
+type SiteStatus struct {
+	Name     string              `json:"name"`
+	Schedule string              `json:"schedule,omitempty"`
+	Next     *time.Time          `json:"next,omitempty"`
+	Run      *RunRecord          `json:"run,omitempty"`
+	Progress []*ProgressSnapshot `json:"progress,omitempty"`
+}
+
+// RunStatus - запись о запуске, у идущего - с прогрессом стадий.
+type RunStatus struct {
+	*RunRecord
+	Progress []*ProgressSnapshot `json:"progress,omitempty"`
+}
+
+type StartRequest struct {
+	Stages []string `json:"stages"`
+}
+
+// SiteReport - отчеты последнего разбора сайта.
+type SiteReport struct {
+	Site       string       `json:"site"`
+	Parse      *ParseReport `json:"parse,omitempty"`
+	FieldStats *FieldStats  `json:"fieldStats,omitempty"`
+}
+
+type ProductsPage struct {
+	Site     string     `json:"site"`
+	Total    int        `json:"total"`
+	Offset   int        `json:"offset"`
+	Limit    int        `json:"limit"`
+	Products []*Product `json:"products"`
+}
+
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+// Handler:
+//
+//	GET    /sites                  - сайты, расписания и идущие запуски
+//	POST   /sites/{site}/runs      - запустить сайт, тело {"stages": [...]} (409 - уже идет)
+//	DELETE /sites/{site}/runs      - отменить идущий запуск
+//	GET    /sites/{site}/report    - отчет об ошибках и заполненность полей
+//	GET    /sites/{site}/products  - товары последнего каталога, ?offset=&limit=
+//	GET    /runs                   - запуски, новые первыми, ?site=&status=&limit=
+//	GET    /runs/{id}              - один запуск
+//	GET    /runs/{id}/report       - отчеты, записанные этим запуском
+//	GET    /proxies                - счетчики прокси, если запросы идут через пул
+//	GET    /metrics                - метрики процесса для Prometheus
+func (a *ControlAPI) Handler() (http.Handler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sites", a.handleSites)
+	mux.HandleFunc("/sites/", a.handleSite)
+	mux.HandleFunc("/runs", a.handleRuns)
+	mux.HandleFunc("/runs/", a.handleRun)
+	mux.HandleFunc("/proxies", a.handleProxies)
+	mux.Handle("/metrics", Metrics.Handler())
+	return mux
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) (bool) {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, r.Method+" not allowed")
+	return false
+}
+
+// splitPath разбирает путь после prefix на части: "/sites/a/runs" -> [a runs].
+func splitPath(path string, prefix string) ([]string) {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
+
+func (a *ControlAPI) handleSites(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	names := make([]string, 0, len(a.Sites))
+	for name := range a.Sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sites := make([]*SiteStatus, 0, len(names))
+	for _, name := range names {
+		status := &SiteStatus{Name: name, Run: a.Scheduler.Active(name)}
+		if job := a.Scheduler.Job(name); job != nil && job.Schedule != nil {
+			status.Schedule = job.Schedule.Spec
+			if next := job.Schedule.Next(time.Now()); !next.IsZero() {
+				status.Next = &next
+			}
+		}
+		if status.Run != nil {
+			status.Progress = ActiveProgress(name)
+		}
+		sites = append(sites, status)
+	}
+	writeJSON(w, sites)
+}
+
+func (a *ControlAPI) handleSite(w http.ResponseWriter, r *http.Request) {
+	parts := splitPath(r.URL.Path, "/sites/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	site := a.Sites[parts[0]]
+	if site == nil {
+		writeError(w, http.StatusNotFound, "unknown site "+strconv.Quote(parts[0]))
+		return
+	}
+
+	switch parts[1] {
+	case "runs":
+		if !allowMethods(w, r, "POST", "DELETE") {
+			return
+		}
+		if r.Method == "POST" {
+			a.startRun(w, r, site)
+		} else {
+			a.cancelRun(w, site)
+		}
+	case "report":
+		if allowMethods(w, r, "GET") {
+			a.siteReport(w, site, "")
+		}
+	case "products":
+		if allowMethods(w, r, "GET") {
+			a.products(w, r, site)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (a *ControlAPI) startRun(w http.ResponseWriter, r *http.Request, site *APISite) {
+	req := new(StartRequest)
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Сайт без расписания запускается один раз, без повторов
+	job := a.Scheduler.Job(site.Name)
+	if job == nil {
+		job = &Job{Site: site.Name, Run: site.Run}
+	}
+	stages := req.Stages
+	if len(stages) == 0 {
+		stages = job.Stages
+	}
+	for _, name := range stages {
+		if len(site.Stages) > 0 && !hasStage(site.Stages, name) {
+			writeError(w, http.StatusBadRequest, "unknown stage "+strconv.Quote(name)+" for "+site.Name)
+			return
+		}
+	}
+
+	record, err := a.Scheduler.Launch(a.ctx, job, "api", stages)
+	if err == ErrRunning {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/runs/"+record.Id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(record)
+}
+
+func hasStage(names []string, name string) (bool) {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ControlAPI) cancelRun(w http.ResponseWriter, site *APISite) {
+	if !a.Scheduler.Cancel(site.Name) {
+		writeError(w, http.StatusNotFound, site.Name+" is not running")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// siteReport отдает отчеты сайта. С непустым run отдаются только отчеты
+// этого запуска, чужие - и более старые, и более новые - отбрасываются.
+func (a *ControlAPI) siteReport(w http.ResponseWriter, site *APISite, run string) {
+	report := &SiteReport{Site: site.Name}
+	var err error
+	if site.ErrorsPath != "" {
+		if report.Parse, err = OpenParseReport(site.ErrorsPath); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if run != "" && report.Parse != nil && report.Parse.Run != run {
+			report.Parse = nil
+		}
+	}
+	if site.StatsPath != "" {
+		if report.FieldStats, err = OpenFieldStats(site.StatsPath); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if run != "" && report.FieldStats != nil && report.FieldStats.Run != run {
+			report.FieldStats = nil
+		}
+	}
+	if report.Parse == nil && report.FieldStats == nil && run != "" {
+		writeError(w, http.StatusNotFound, "no report for run "+strconv.Quote(run))
+		return
+	}
+	if report.Parse == nil && report.FieldStats == nil {
+		writeError(w, http.StatusNotFound, "no report for "+site.Name)
+		return
+	}
+	writeJSON(w, report)
+}
+
+func (a *ControlAPI) products(w http.ResponseWriter, r *http.Request, site *APISite) {
+	query := r.URL.Query()
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "bad offset")
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), DefaultPageLimit)
+	if err != nil || limit < 1 {
+		writeError(w, http.StatusBadRequest, "bad limit")
+		return
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+
+	products, err := a.loadProducts(site)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	page := &ProductsPage{Site: site.Name, Total: len(products), Offset: offset, Limit: limit, Products: make([]*Product, 0)}
+	if offset < len(products) {
+		end := offset + limit
+		if end > len(products) {
+			end = len(products)
+		}
+		page.Products = products[offset:end]
+	}
+	writeJSON(w, page)
+}
+
+func queryInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// loadProducts читает каталог сайта и держит его в памяти CacheTTL или
+// до конца следующего запуска сайта, чтобы листание страниц не читало
+// файл заново.
+func (a *ControlAPI) loadProducts(site *APISite) ([]*Product, error) {
+	a.m.Lock()
+	cached := a.cache[site.Name]
+	a.m.Unlock()
+	if cached != nil && time.Since(cached.loaded) < a.CacheTTL && !a.finishedSince(site.Name, cached.loaded) {
+		return cached.products, nil
+	}
+
+	if site.Products == nil {
+		return nil, errors.New(site.Name + " has no catalog")
+	}
+	loaded := time.Now()
+	products, err := site.Products()
+	if err != nil {
+		return nil, err
+	}
+	a.m.Lock()
+	a.cache[site.Name] = &productsCache{loaded: loaded, products: products}
+	a.m.Unlock()
+	return products, nil
+}
+
+func (a *ControlAPI) finishedSince(site string, t time.Time) (bool) {
+	for _, r := range a.Scheduler.History() {
+		if r.Site == site && r.Finished != nil && r.Finished.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ControlAPI) handleRuns(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), DefaultPageLimit)
+	if err != nil || limit < 1 {
+		writeError(w, http.StatusBadRequest, "bad limit")
+		return
+	}
+
+	history := a.Scheduler.History()
+	runs := make([]*RunStatus, 0)
+	for i := len(history) - 1; i >= 0 && len(runs) < limit; i-- {
+		record := history[i]
+		if site := query.Get("site"); site != "" && record.Site != site {
+			continue
+		}
+		if status := query.Get("status"); status != "" && record.Status != status {
+			continue
+		}
+		runs = append(runs, a.runStatus(record))
+	}
+	writeJSON(w, runs)
+}
+
+func (a *ControlAPI) runStatus(record *RunRecord) (*RunStatus) {
+	status := &RunStatus{RunRecord: record}
+	if record.Status == RunRunning {
+		status.Progress = ActiveProgress(record.Site)
+	}
+	return status
+}
+
+func (a *ControlAPI) handleRun(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	parts := splitPath(r.URL.Path, "/runs/")
+	if len(parts) == 0 || len(parts) > 2 || (len(parts) == 2 && parts[1] != "report") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	var record *RunRecord
+	for _, run := range a.Scheduler.History() {
+		if run.Id == parts[0] {
+			record = run
+			break
+		}
+	}
+	if record == nil {
+		writeError(w, http.StatusNotFound, "unknown run "+strconv.Quote(parts[0]))
+		return
+	}
+	if len(parts) == 1 {
+		writeJSON(w, a.runStatus(record))
+		return
+	}
+
+	site := a.Sites[record.Site]
+	if site == nil {
+		writeError(w, http.StatusNotFound, "unknown site "+strconv.Quote(record.Site))
+		return
+	}
+	a.siteReport(w, site, record.Id)
+}
+
+func (a *ControlAPI) handleProxies(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	if Proxies == nil {
+		writeJSON(w, []*ProxyStats{})
+		return
+	}
+	writeJSON(w, Proxies.Stats())
+}
+
+// Serve отдает api на listen до отмены ctx.
+func (a *ControlAPI) Serve(ctx context.Context, listen string) (error) {
+	server := &http.Server{Addr: listen, Handler: a.Handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	L(ctx).Info("control api listening", "listen", listen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package libs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type CanaryResult struct {
+	Url      string
+	Product  *Product
+	Problems []string
+	Err      error
+}
+
+// RunCanary скачивает несколько заведомо товарных страниц, разбирает их и
+// проверяет обязательные поля и заполненность относительно прошлого запуска
+// из statsFile. Статистика сохраняется только для успешного запуска, чтобы
+// следующий запуск сравнивался со здоровым состоянием сайта.
+func RunCanary(ctx context.Context, site string, urls []string, charset string, parse ParseFunc, rules *HealthRules, statsFile string) ([]*CanaryResult, []string, error) {
+	if len(urls) == 0 {
+		return nil, nil, fmt.Errorf("%s: no canary urls", site)
+	}
+
+	dir, err := ioutil.TempDir("", "canary-"+site)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	stats := NewFieldStats(site, RunOf(ctx))
+	results := make([]*CanaryResult, 0, len(urls))
+	problems := make([]string, 0)
+	for i, url := range urls {
+		if err := ctx.Err(); err != nil {
+			return results, problems, err
+		}
+		result := &CanaryResult{Url: url}
+		results = append(results, result)
+
+		file := filepath.Join(dir, fmt.Sprintf("canary%d.html", i))
+		if err := DownloadPageContext(ctx, url, file, charset); err != nil {
+			result.Err = FetchError(file, url, err)
+		} else {
+			result.Product, result.Err = parse(file)
+		}
+		if result.Err == nil && result.Product == nil {
+			result.Err = NotProductError(file, url, "no product on the page")
+		}
+		if result.Err != nil {
+			problems = append(problems, url+": "+result.Err.Error())
+			continue
+		}
+
+		result.Product.Url = url
+		stats.Add(result.Product)
+		for _, field := range rules.Required {
+			if !productField(result.Product, field) {
+				result.Problems = append(result.Problems, "required field "+field+" is empty")
+				problems = append(problems, url+": required field "+field+" is empty")
+			}
+		}
+	}
+
+	previous, err := OpenFieldStats(statsFile)
+	if err != nil {
+		return results, problems, err
+	}
+	// Обязательные поля уже проверены по каждому товару
+	check := *rules
+	check.Required = nil
+	problems = append(problems, check.Check(stats, previous)...)
+
+	if len(problems) == 0 {
+		if err := SaveFieldStats(stats, statsFile); err != nil {
+			return results, problems, err
+		}
+	}
+	return results, problems, nil
+}
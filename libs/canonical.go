@@ -0,0 +1,165 @@
+package libs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"github.com/PuerkitoBio/goquery"
+)
+
+const (
+	TrailingSlashKeep  = ""
+	TrailingSlashAdd   = "add"
+	TrailingSlashStrip = "strip"
+)
+
+// CanonicalRules - как привести адрес товара к одному виду, чтобы один
+// товар из карты сайта под разными адресами качался один раз.
+type CanonicalRules struct {
+	// Параметры, которые выкидываются: "utm_*" - все с префиксом utm_
+	StripParams []string
+	// Если задан, остаются только эти параметры, StripParams не нужен
+	KeepParams []string
+	// Путь в нижний регистр, если сайт к регистру не чувствителен
+	LowerPath bool
+	// TrailingSlashAdd, TrailingSlashStrip или как есть
+	TrailingSlash string
+	// Псевдонимы разделов: префикс пути -> канонический префикс,
+	// "/catalog/instrument/" -> "/instrument/"
+	Aliases map[string]string
+}
+
+var DefaultCanonicalRules = &CanonicalRules{
+	StripParams: []string{"utm_*", "gclid", "yclid", "fbclid", "_openstat", "openstat", "from", "ref", "referrer", "sessionid", "PHPSESSID"},
+}
+
+func paramMatches(name string, patterns []string) (bool) {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if strings.EqualFold(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Canonical возвращает канонический адрес: NormalizeUrl, псевдонимы
+// разделов, регистр и слеш в конце пути, параметры без мусора и по
+// алфавиту. nil-правила - DefaultCanonicalRules. Адрес, который не
+// разбирается, возвращается как есть.
+func (r *CanonicalRules) Canonical(rawUrl string) (string) {
+	if r == nil {
+		r = DefaultCanonicalRules
+	}
+	u, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil || u.Host == "" {
+		return rawUrl
+	}
+
+	path := u.Path
+	if r.LowerPath {
+		path = strings.ToLower(path)
+	}
+	// Длинный префикс раньше короткого, чтобы вложенные разделы не путались
+	prefixes := make([]string, 0, len(r.Aliases))
+	for prefix := range r.Aliases {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) (bool) {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			path = r.Aliases[prefix] + strings.TrimPrefix(path, prefix)
+			break
+		}
+	}
+	switch r.TrailingSlash {
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(path, "/") && !strings.Contains(path[strings.LastIndex(path, "/")+1:], ".") {
+			path += "/"
+		}
+	case TrailingSlashStrip:
+		if len(path) > 1 {
+			path = strings.TrimRight(path, "/")
+		}
+	}
+	if path != u.Path {
+		u.Path = path
+		u.RawPath = ""
+	}
+
+	query := u.Query()
+	for name := range query {
+		if (len(r.KeepParams) > 0 && !paramMatches(name, r.KeepParams)) || paramMatches(name, r.StripParams) {
+			query.Del(name)
+		}
+	}
+	// Encode сортирует параметры по имени
+	u.RawQuery = query.Encode()
+	u.ForceQuery = false
+	return NormalizeUrl(u)
+}
+
+// CanonicalUrls приводит адреса к каноническим и убирает повторы,
+// сохраняя порядок первого появления.
+func CanonicalUrls(urls []string, rules *CanonicalRules) ([]string) {
+	seen := make(map[string]bool, len(urls))
+	result := make([]string, 0, len(urls))
+	for _, u := range urls {
+		c := rules.Canonical(u)
+		if !seen[c] {
+			seen[c] = true
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// CanonicalLink возвращает адрес из <link rel="canonical"> страницы,
+// скачанной с pageUrl, или пустую строку.
+func CanonicalLink(body []byte, pageUrl string) (string) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	href, ok := doc.Find("link[rel=\"canonical\"][href]").First().Attr("href")
+	if !ok {
+		return ""
+	}
+	return ResolveUrl(DocumentBase(pageUrl, doc, ""), href)
+}
+
+// CanonicalPage ставит товару, разобранному из сохраненной страницы file,
+// канонический адрес так же, как потоковый режим: по rel=canonical или
+// по правилам source, адрес скачивания уходит в Aliases.
+func CanonicalPage(source *StreamSource, product *Product, file string) {
+	// без тела страницы остаются правила
+	body, _ := ioutil.ReadFile(file)
+	canonicalProduct(source, product, body, PageUrl(file))
+}
+
+// canonicalProduct ставит товару канонический адрес: из rel=canonical,
+// если он есть, иначе по правилам. Адрес, с которого товар скачан, если
+// он другой, уходит в Aliases.
+func canonicalProduct(source *StreamSource, product *Product, body []byte, fetched string) {
+	canonical := CanonicalLink(body, product.Url)
+	if canonical == "" {
+		canonical = product.Url
+	}
+	if canonical == "" {
+		canonical = fetched
+	}
+	canonical = source.Canonical.Canonical(canonical)
+	previous := product.Url
+	product.Url = canonical
+	for _, u := range []string{previous, fetched} {
+		if u != "" {
+			product.addAlias(u)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package libs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	aliases := &CanonicalRules{
+		TrailingSlash: TrailingSlashAdd,
+		Aliases: map[string]string{
+			"/catalog/":            "/",
+			"/catalog/instrument/": "/instrument/",
+		},
+	}
+	cases := []struct {
+		name  string
+		rules *CanonicalRules
+		url   string
+		want  string
+	}{
+		{"default strips tracking", nil, "HTTP://Shop.RU:80/Item?utm_source=ya&utm_medium=cpc&id=5&gclid=x#top", "http://shop.ru/Item?id=5"},
+		{"default sorts params", nil, "https://shop.ru:443/item?b=2&a=1&ref=main", "https://shop.ru/item?a=1&b=2"},
+		{"empty query and path", nil, "https://shop.ru?", "https://shop.ru/"},
+		{"not a url", nil, "page1.html", "page1.html"},
+		{"strip prefix", &CanonicalRules{StripParams: []string{"sort*"}}, "https://shop.ru/list?sort=price&sortDir=asc&page=2", "https://shop.ru/list?page=2"},
+		{"strip ignores case", &CanonicalRules{StripParams: []string{"phpsessid"}}, "https://shop.ru/item?PHPSESSID=1", "https://shop.ru/item"},
+		{"keep params", &CanonicalRules{KeepParams: []string{"id", "color*"}}, "https://shop.ru/item?id=5&colorId=2&view=full", "https://shop.ru/item?colorId=2&id=5"},
+		{"keep and strip", &CanonicalRules{KeepParams: []string{"id", "utm_*"}, StripParams: []string{"utm_*"}}, "https://shop.ru/item?id=5&utm_source=ya", "https://shop.ru/item?id=5"},
+		{"lower path", &CanonicalRules{LowerPath: true}, "https://shop.ru/Item/ABC", "https://shop.ru/item/abc"},
+		{"keep path case", &CanonicalRules{}, "https://shop.ru/Item/ABC", "https://shop.ru/Item/ABC"},
+		{"add slash", &CanonicalRules{TrailingSlash: TrailingSlashAdd}, "https://shop.ru/item/5", "https://shop.ru/item/5/"},
+		{"add slash skips files", &CanonicalRules{TrailingSlash: TrailingSlashAdd}, "https://shop.ru/item/5.html", "https://shop.ru/item/5.html"},
+		{"strip slash", &CanonicalRules{TrailingSlash: TrailingSlashStrip}, "https://shop.ru/item/5//", "https://shop.ru/item/5"},
+		{"strip slash keeps root", &CanonicalRules{TrailingSlash: TrailingSlashStrip}, "https://shop.ru/", "https://shop.ru/"},
+		{"alias", aliases, "https://shop.ru/catalog/sad/lopata", "https://shop.ru/sad/lopata/"},
+		{"longest alias", aliases, "https://shop.ru/catalog/instrument/drel", "https://shop.ru/instrument/drel/"},
+		{"no alias", aliases, "https://shop.ru/instrument/drel/", "https://shop.ru/instrument/drel/"},
+		{"alias after lower", &CanonicalRules{LowerPath: true, Aliases: map[string]string{"/old/": "/new/"}}, "https://shop.ru/OLD/Item", "https://shop.ru/new/item"},
+	}
+	for _, c := range cases {
+		if got := c.rules.Canonical(c.url); got != c.want {
+			t.Errorf("%s: Canonical(%q) = %q, want %q", c.name, c.url, got, c.want)
+		}
+	}
+}
+
+func TestCanonicalUrls(t *testing.T) {
+	urls := []string{
+		"https://shop.ru/b?utm_source=ya",
+		"https://shop.ru/a",
+		"https://SHOP.ru/b",
+		"https://shop.ru/a#reviews",
+	}
+	want := []string{"https://shop.ru/b", "https://shop.ru/a"}
+	if got := CanonicalUrls(urls, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("CanonicalUrls = %v, want %v", got, want)
+	}
+}
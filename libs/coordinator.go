@@ -0,0 +1,682 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type LeaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+type Lease struct {
+	Id      string    `json:"id"`
+	Site    string    `json:"site"`
+	Urls    []string  `json:"urls"`
+	Expires time.Time `json:"expires"`
+}
+
+type UrlResult struct {
+	Url     string    `json:"url"`
+	Product *Product  `json:"product,omitempty"`
+	Kind    ErrorKind `json:"kind,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type LeaseReport struct {
+	Lease   string       `json:"lease"`
+	Worker  string       `json:"worker"`
+	Results []*UrlResult `json:"results"`
+}
+
+type CoordinatorStatus struct {
+	Site     string `json:"site"`
+	Seeding  bool   `json:"seeding"`
+	Queued   int    `json:"queued"`
+	Leased   int    `json:"leased"`
+	Done     int    `json:"done"`
+	Failed   int    `json:"failed"`
+	Products int    `json:"products"`
+	Workers  int    `json:"workers"`
+}
+
+type activeLease struct {
+	lease  *Lease
+	worker string
+}
+
+// CrawlState - то, что нужно, чтобы продолжить обход после перезапуска
+// координатора: адреса в очереди (включая выданные) и обработанные.
+type CrawlState struct {
+	Site   string   `json:"site"`
+	Queued []string `json:"queued"`
+	Done   []string `json:"done"`
+	// Обработанные адреса, с которых товара не будет: ошибки и не товары
+	Empty    []string       `json:"empty,omitempty"`
+	Attempts map[string]int `json:"attempts"`
+}
+
+// Coordinator владеет очередью адресов обхода и выдает ее воркерам
+// пачками в аренду. Аренда, по которой не пришел отчет за LeaseTimeout,
+// возвращается в очередь.
+type Coordinator struct {
+	Source       *StreamSource
+	BatchSize    int
+	LeaseTimeout time.Duration
+	// Сколько раз пробовать адрес, который не удалось скачать
+	MaxAttempts int
+	Sink        func(p *Product) (error)
+	Report      *ParseReport
+	Stats       *FieldStats
+	Progress    *Progress
+
+	m        sync.Mutex
+	seeding  bool
+	queue    []string
+	known    map[string]bool
+	done     map[string]bool
+	empty    map[string]bool
+	attempts map[string]int
+	leases   map[string]*activeLease
+	workers  map[string]time.Time
+	failed   int
+	products int
+	nextId   int
+	finished chan struct{}
+}
+
+func NewCoordinator(source *StreamSource, sink func(p *Product) (error)) (*Coordinator) {
+	return &Coordinator{
+		Source:       source,
+		BatchSize:    20,
+		LeaseTimeout: 5 * time.Minute,
+		MaxAttempts:  3,
+		Sink:         sink,
+		Report:       NewParseReport(source.Site, "distributed", ""),
+		Stats:        NewFieldStats(source.Site, ""),
+		known:        make(map[string]bool),
+		done:         make(map[string]bool),
+		empty:        make(map[string]bool),
+		attempts:     make(map[string]int),
+		leases:       make(map[string]*activeLease),
+		workers:      make(map[string]time.Time),
+		finished:     make(chan struct{}),
+	}
+}
+
+// Restore подхватывает сохраненное состояние обхода. written - адреса
+// товаров, которые уже лежат в файле: обработанный адрес без товара в
+// файле и без отметки "товара не будет" обходится заново, как и адрес
+// из очереди, товар которого записан, второй раз не качается.
+func (c *Coordinator) Restore(state *CrawlState, written map[string]bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	empty := make(map[string]bool, len(state.Empty))
+	for _, url := range state.Empty {
+		empty[url] = true
+	}
+	requeue := make([]string, 0)
+	for _, url := range state.Done {
+		if !written[url] && !empty[url] {
+			requeue = append(requeue, url)
+			continue
+		}
+		c.known[url] = true
+		c.done[url] = true
+		c.empty[url] = empty[url]
+		c.Progress.Add(1)
+		c.Progress.Done()
+	}
+	for _, url := range append(state.Queued, requeue...) {
+		if c.known[url] {
+			continue
+		}
+		c.known[url] = true
+		c.Progress.Add(1)
+		if written[url] {
+			c.done[url] = true
+			c.Progress.Done()
+			continue
+		}
+		c.queue = append(c.queue, url)
+	}
+	for url, n := range state.Attempts {
+		c.attempts[url] = n
+	}
+	c.queueChanged()
+}
+
+// queueChanged обновляет метрику длины очереди, вызывается под c.m.
+func (c *Coordinator) queueChanged() {
+	QueueDepth.Set(float64(len(c.queue)), c.Source.Site, "coordinator")
+}
+
+func (c *Coordinator) State() (*CrawlState) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	state := &CrawlState{Site: c.Source.Site, Queued: make([]string, 0), Done: make([]string, 0), Attempts: make(map[string]int)}
+	for url, n := range c.attempts {
+		state.Attempts[url] = n
+	}
+	state.Queued = append(state.Queued, c.queue...)
+	for _, l := range c.leases {
+		state.Queued = append(state.Queued, l.lease.Urls...)
+	}
+	for url := range c.done {
+		state.Done = append(state.Done, url)
+		if c.empty[url] {
+			state.Empty = append(state.Empty, url)
+		}
+	}
+	return state
+}
+
+func SaveCrawlState(state *CrawlState, filename string) (error) {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// OpenCrawlState возвращает nil без ошибки, если состояния еще нет.
+func OpenCrawlState(filename string) (*CrawlState, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := new(CrawlState)
+	return state, json.Unmarshal(b, state)
+}
+
+// Seed наполняет очередь адресами из карты сайта. Если карта сайта не
+// прочитана целиком, обход не считается законченным.
+func (c *Coordinator) Seed(ctx context.Context) (err error) {
+	c.m.Lock()
+	c.seeding = true
+	c.m.Unlock()
+	defer func() {
+		if err != nil {
+			return
+		}
+		c.m.Lock()
+		c.seeding = false
+		c.checkFinished()
+		c.m.Unlock()
+	}()
+
+	return FetchSitemap(ctx, c.Source.SiteMapUrl, func(url string) (error) {
+		if c.Source.Filter != nil && !c.Source.Filter(url) {
+			return nil
+		}
+		url = c.Source.Canonical.Canonical(url)
+		c.m.Lock()
+		if !c.known[url] {
+			c.known[url] = true
+			c.queue = append(c.queue, url)
+			c.Progress.Add(1)
+			c.queueChanged()
+		}
+		c.m.Unlock()
+		return nil
+	})
+}
+
+// Finished закрывается, когда очередь пуста, аренд нет и карта сайта
+// прочитана целиком.
+func (c *Coordinator) Finished() (<-chan struct{}) {
+	return c.finished
+}
+
+func (c *Coordinator) checkFinished() {
+	if c.seeding || len(c.queue) > 0 || len(c.leases) > 0 {
+		return
+	}
+	select {
+	case <-c.finished:
+	default:
+		close(c.finished)
+	}
+}
+
+func (c *Coordinator) lease(worker string) (*Lease) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.workers[worker] = time.Now()
+
+	n := c.BatchSize
+	if n > len(c.queue) {
+		n = len(c.queue)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	c.nextId++
+	lease := &Lease{
+		Id:      strconv.Itoa(c.nextId),
+		Site:    c.Source.Site,
+		Urls:    append([]string(nil), c.queue[:n]...),
+		Expires: time.Now().Add(c.LeaseTimeout),
+	}
+	c.queue = c.queue[n:]
+	c.queueChanged()
+	c.leases[lease.Id] = &activeLease{lease: lease, worker: worker}
+	return lease
+}
+
+func (c *Coordinator) report(r *LeaseReport) (error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.workers[r.Worker] = time.Now()
+
+	active, ok := c.leases[r.Lease]
+	if !ok {
+		// Аренда уже истекла и адреса отданы другому воркеру
+		return fmt.Errorf("lease %s is not active", r.Lease)
+	}
+	delete(c.leases, r.Lease)
+
+	// Адреса, о которых воркер ничего не сказал, возвращаются в очередь
+	reported := make(map[string]bool)
+	requeue := func() {
+		for _, url := range active.lease.Urls {
+			if !reported[url] && !c.done[url] {
+				c.queue = append(c.queue, url)
+			}
+		}
+		c.queueChanged()
+	}
+	for i, result := range r.Results {
+		reported[result.Url] = true
+		if c.done[result.Url] {
+			continue
+		}
+
+		switch {
+		case result.Error == "":
+			if err := c.Sink(result.Product); err != nil {
+				// Остаток отчета не принят, его адреса обойдутся заново
+				for _, rest := range r.Results[i:] {
+					reported[rest.Url] = false
+				}
+				requeue()
+				return err
+			}
+			c.done[result.Url] = true
+			c.products++
+			c.Progress.Done()
+			c.Report.Ok()
+			c.Stats.Add(result.Product)
+		case result.Kind == ErrorFetch && c.attempts[result.Url]+1 < c.MaxAttempts:
+			c.attempts[result.Url]++
+			c.queue = append(c.queue, result.Url)
+			RetriesTotal.Inc(c.Source.Site)
+		case result.Kind == ErrorNotProduct:
+			c.done[result.Url] = true
+			c.empty[result.Url] = true
+			c.Progress.Done()
+			c.Report.NotProduct(result.Url)
+		default:
+			c.done[result.Url] = true
+			c.empty[result.Url] = true
+			c.failed++
+			c.Progress.Fail()
+			c.Report.Add(result.Url, &PageError{Kind: result.Kind, File: result.Url, Url: result.Url, Err: errors.New(result.Error)})
+		}
+	}
+	requeue()
+	c.checkFinished()
+	return nil
+}
+
+// Expire возвращает в очередь адреса просроченных аренд.
+func (c *Coordinator) Expire(now time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for id, active := range c.leases {
+		if now.Before(active.lease.Expires) {
+			continue
+		}
+		Log.Site(c.Source.Site).Warn("lease expired", "lease", id, "worker", active.worker, "requeued", len(active.lease.Urls))
+		delete(c.leases, id)
+		for _, url := range active.lease.Urls {
+			if !c.done[url] {
+				c.queue = append(c.queue, url)
+			}
+		}
+	}
+	c.queueChanged()
+	c.checkFinished()
+}
+
+func (c *Coordinator) Status() (*CoordinatorStatus) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	leased := 0
+	for _, l := range c.leases {
+		leased += len(l.lease.Urls)
+	}
+	return &CoordinatorStatus{
+		Site:     c.Source.Site,
+		Seeding:  c.seeding,
+		Queued:   len(c.queue),
+		Leased:   leased,
+		Done:     len(c.done),
+		Failed:   c.failed,
+		Products: c.products,
+		Workers:  len(c.workers),
+	}
+}
+
+// Handler - http api координатора:
+//
+//	POST /lease  - выдать пачку адресов (204 - пока пусто, 410 - обход закончен)
+//	POST /report - принять результаты по аренде
+//	GET  /status - счетчики обхода
+//	GET  /metrics - метрики процесса для Prometheus
+func (c *Coordinator) Handler() (http.Handler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lease", func(w http.ResponseWriter, r *http.Request) {
+		req := new(LeaseRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case <-c.finished:
+			w.WriteHeader(http.StatusGone)
+			return
+		default:
+		}
+		lease := c.lease(req.Worker)
+		if lease == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, lease)
+	})
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		report := new(LeaseReport)
+		if err := json.NewDecoder(r.Body).Decode(report); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.report(report); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.Status())
+	})
+	mux.Handle("/metrics", Metrics.Handler())
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Worker арендует у координатора пачки адресов, качает и разбирает их
+// и отправляет результат обратно.
+type Worker struct {
+	Name        string
+	Coordinator string
+	Source      *StreamSource
+	Parallel    int
+	// Пауза, когда у координатора пока нет работы
+	Idle     time.Duration
+	Progress *Progress
+
+	limit     chan struct{}
+	followUps *FollowUpFetcher
+}
+
+func (w *Worker) post(ctx context.Context, path string, in interface{}, out interface{}) (int, error) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", w.Coordinator+path, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK && out != nil {
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+	}
+	if res.StatusCode >= 400 && res.StatusCode != http.StatusGone {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, fmt.Errorf("%s%s: %s: %s", w.Coordinator, path, res.Status, bytes.TrimSpace(msg))
+	}
+	return res.StatusCode, nil
+}
+
+// Run работает, пока координатор не скажет, что обход закончен, или
+// не будет отменен ctx.
+func (w *Worker) Run(ctx context.Context) (error) {
+	idle := w.Idle
+	if idle == 0 {
+		idle = 2 * time.Second
+	}
+	ctx = WithLogger(ctx, L(ctx).Site(w.Source.Site).With("worker", w.Name))
+	// Страницы и дополнительные запросы делят общий лимит сайта
+	w.limit = SiteLimit(w.Source.Site, w.Parallel)
+	w.followUps = NewFollowUpFetcher(w.Source.Site, w.limit, "")
+
+	for {
+		lease := new(Lease)
+		status, err := w.post(ctx, "/lease", &LeaseRequest{Worker: w.Name}, lease)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			L(ctx).Warn("lease request failed", "coordinator", w.Coordinator, "error", err)
+			status = http.StatusNoContent
+		}
+		switch status {
+		case http.StatusGone:
+			return nil
+		case http.StatusOK:
+			w.Progress.Add(len(lease.Urls))
+			report := &LeaseReport{Lease: lease.Id, Worker: w.Name, Results: w.process(ctx, lease.Urls)}
+			if ctx.Err() != nil {
+				// Незаконченную аренду координатор вернет в очередь сам
+				return ctx.Err()
+			}
+			if _, err := w.post(ctx, "/report", report, nil); err != nil {
+				L(ctx).Warn("lease report failed", "lease", lease.Id, "coordinator", w.Coordinator, "error", err)
+			}
+			continue
+		}
+
+		select {
+		case <-time.After(idle):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *Worker) process(ctx context.Context, urls []string) ([]*UrlResult) {
+	parallel := w.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make([]*UrlResult, len(urls))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, url string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = w.processUrl(ctx, url)
+		}(i, url)
+	}
+	wg.Wait()
+	return results
+}
+
+func (w *Worker) processUrl(ctx context.Context, url string) (*UrlResult) {
+	result := &UrlResult{Url: url}
+	if err := acquire(ctx, w.limit); err != nil {
+		result.Kind, result.Error = ErrorFetch, err.Error()
+		return result
+	}
+	final, body, err := FetchPage(ctx, url, w.Source.Charset)
+	release(w.limit)
+	if err != nil {
+		result.Kind, result.Error = ErrorFetch, err.Error()
+		L(ctx).Warn("fetch failed", "url", url, "error", err)
+		w.Progress.Fail()
+		return result
+	}
+	w.Progress.AddBytes(int64(len(body)))
+	product, err := w.Source.Parse(bytes.NewReader(body), final, url)
+	if err != nil {
+		result.Kind, result.Error = ErrorDecode, err.Error()
+		if pe, ok := err.(*PageError); ok {
+			result.Kind = pe.Kind
+		}
+		if result.Kind == ErrorNotProduct {
+			w.Progress.Done()
+		} else {
+			L(ctx).Warn("parse failed", "url", url, "error", err)
+			w.Progress.Fail()
+		}
+		return result
+	}
+	canonicalProduct(w.Source, product, body, url)
+	w.followUps.Run(ctx, product)
+	result.Product = product
+	w.Progress.Done()
+	return result
+}
+
+// RunCoordinator поднимает координатор на listen, наполняет очередь из
+// карты сайта и ждет, пока воркеры не обработают все адреса. Состояние
+// периодически сохраняется в statePath, чтобы обход можно было продолжить.
+func RunCoordinator(ctx context.Context, source *StreamSource, listen string, output string, statePath string, errorsPath string, rules *HealthRules, statsPath string) (error) {
+	ctx = WithLogger(ctx, L(ctx).Site(source.Site).Stage("coordinator"))
+	state, err := OpenCrawlState(statePath)
+	if err != nil {
+		return err
+	}
+	// Товары прошлого запуска переписываются в новый файл, иначе
+	// продолжение обхода потеряет их вместе с пометкой "обработан"
+	var previous []*Product
+	if state != nil {
+		if previous, err = RecoverProducts(output); err != nil {
+			return err
+		}
+	}
+	w, err := CreateProductWriter(output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	written := make(map[string]bool, len(previous))
+	for _, p := range previous {
+		if err := w.Write(p); err != nil {
+			return err
+		}
+		written[p.Url] = true
+		for _, alias := range p.Aliases {
+			written[alias] = true
+		}
+	}
+
+	c := NewCoordinator(source, w.Write)
+	c.Report.Run, c.Stats.Run = RunOf(ctx), RunOf(ctx)
+	c.Progress = NewProgress(source.Site, "coordinator", 0)
+	defer c.Progress.Finish()
+	if state != nil {
+		L(ctx).Info("resume crawl", "file", statePath, "queued", len(state.Queued), "done", len(state.Done), "products", len(previous))
+		c.Restore(state, written)
+	}
+
+	server := &http.Server{Addr: listen, Handler: c.Handler()}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	defer server.Close()
+	L(ctx).Info("coordinator listening", "listen", listen)
+
+	seedErr := make(chan error, 1)
+	go func() {
+		seedErr <- c.Seed(ctx)
+	}()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Expire(time.Now())
+			if err := SaveCrawlState(c.State(), statePath); err != nil {
+				L(ctx).Error("crawl state not saved", "file", statePath, "error", err)
+			}
+		case <-c.Finished():
+			// Даем воркерам забрать ответ 410 и закончить
+			time.Sleep(2 * time.Second)
+			if err := c.Report.Save(errorsPath); err != nil {
+				L(ctx).Error("parse report not saved", "file", errorsPath, "error", err)
+			}
+			CheckRun(ctx, rules, c.Stats, statsPath)
+			os.Remove(statePath)
+			if err := w.Close(); err != nil {
+				return err
+			}
+			if err := DedupeFile(ctx, output); err != nil {
+				return err
+			}
+			status := c.Status()
+			L(ctx).Info("crawl finished", "products", status.Products, "failed", status.Failed)
+			return nil
+		case err := <-seedErr:
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			// Без карты сайта обход не закончить, состояние остается для
+			// продолжения
+			if err := SaveCrawlState(c.State(), statePath); err != nil {
+				L(ctx).Error("crawl state not saved", "file", statePath, "error", err)
+			}
+			return fmt.Errorf("sitemap %s: %v", source.SiteMapUrl, err)
+		case err := <-serverErr:
+			return err
+		case <-ctx.Done():
+			if err := SaveCrawlState(c.State(), statePath); err != nil {
+				L(ctx).Error("crawl state not saved", "file", statePath, "error", err)
+			}
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package libs
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestCoordinator(sink func(p *Product) (error), urls ...string) (*Coordinator) {
+	if sink == nil {
+		sink = func(p *Product) (error) { return nil }
+	}
+	c := NewCoordinator(&StreamSource{Site: "coordinatortest"}, sink)
+	c.Restore(&CrawlState{Queued: urls}, nil)
+	return c
+}
+
+func sorted(urls []string) ([]string) {
+	urls = append([]string{}, urls...)
+	sort.Strings(urls)
+	return urls
+}
+
+func TestCoordinatorExpire(t *testing.T) {
+	c := newTestCoordinator(nil, "a", "b", "c")
+	c.BatchSize = 2
+	c.LeaseTimeout = time.Minute
+
+	lease := c.lease("w1")
+	if !reflect.DeepEqual(lease.Urls, []string{"a", "b"}) {
+		t.Fatalf("leased %v, want [a b]", lease.Urls)
+	}
+	c.Expire(time.Now())
+	if s := c.Status(); s.Queued != 1 || s.Leased != 2 {
+		t.Fatalf("before timeout: %+v, want 1 queued and 2 leased", s)
+	}
+	c.Expire(time.Now().Add(2 * time.Minute))
+	if s := c.Status(); s.Queued != 3 || s.Leased != 0 {
+		t.Fatalf("after timeout: %+v, want 3 queued", s)
+	}
+	if !reflect.DeepEqual(c.queue, []string{"c", "a", "b"}) {
+		t.Errorf("queue %v, want [c a b]", c.queue)
+	}
+
+	// Отчет по просроченной аренде не принимается, адреса уже в очереди
+	err := c.report(&LeaseReport{Lease: lease.Id, Worker: "w1", Results: []*UrlResult{{Url: "a", Product: &Product{Name: "A"}}}})
+	if err == nil {
+		t.Error("report on expired lease accepted")
+	}
+	if s := c.Status(); s.Done != 0 || s.Queued != 3 {
+		t.Errorf("after late report: %+v, want nothing done", s)
+	}
+}
+
+func TestCoordinatorReport(t *testing.T) {
+	cases := []struct {
+		name    string
+		result  *UrlResult
+		attempt int
+		queued  bool
+		done    bool
+		empty   bool
+		failed  int
+	}{
+		{"product", &UrlResult{Url: "u", Product: &Product{Name: "U"}}, 0, false, true, false, 0},
+		{"fetch retry", &UrlResult{Url: "u", Kind: ErrorFetch, Error: "timeout"}, 0, true, false, false, 0},
+		{"fetch last attempt", &UrlResult{Url: "u", Kind: ErrorFetch, Error: "timeout"}, 2, false, true, true, 1},
+		{"not product", &UrlResult{Url: "u", Kind: ErrorNotProduct, Error: "no product"}, 0, false, true, true, 0},
+		{"decode", &UrlResult{Url: "u", Kind: ErrorDecode, Error: "bad html"}, 0, false, true, true, 1},
+		{"not reported", nil, 0, true, false, false, 0},
+	}
+	for _, c := range cases {
+		coordinator := newTestCoordinator(nil, "u")
+		coordinator.attempts["u"] = c.attempt
+		lease := coordinator.lease("w1")
+		report := &LeaseReport{Lease: lease.Id, Worker: "w1"}
+		if c.result != nil {
+			report.Results = append(report.Results, c.result)
+		}
+		if err := coordinator.report(report); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		queued := len(coordinator.queue) == 1
+		if queued != c.queued || coordinator.done["u"] != c.done || coordinator.empty["u"] != c.empty || coordinator.failed != c.failed {
+			t.Errorf("%s: queued %v, done %v, empty %v, failed %d, want %v, %v, %v, %d", c.name,
+				queued, coordinator.done["u"], coordinator.empty["u"], coordinator.failed, c.queued, c.done, c.empty, c.failed)
+		}
+		if c.name == "fetch retry" && coordinator.attempts["u"] != 1 {
+			t.Errorf("%s: %d attempts, want 1", c.name, coordinator.attempts["u"])
+		}
+	}
+}
+
+func TestCoordinatorSinkError(t *testing.T) {
+	written := make([]string, 0)
+	c := newTestCoordinator(func(p *Product) (error) {
+		if p.Name == "B" {
+			return errors.New("disk full")
+		}
+		written = append(written, p.Name)
+		return nil
+	}, "a", "b", "c")
+	lease := c.lease("w1")
+	err := c.report(&LeaseReport{Lease: lease.Id, Worker: "w1", Results: []*UrlResult{
+		{Url: "a", Product: &Product{Name: "A"}},
+		{Url: "b", Product: &Product{Name: "B"}},
+		{Url: "c", Product: &Product{Name: "C"}},
+	}})
+	if err == nil {
+		t.Fatal("sink error not returned")
+	}
+	if !reflect.DeepEqual(written, []string{"A"}) {
+		t.Errorf("written %v, want [A]", written)
+	}
+	if !reflect.DeepEqual(c.queue, []string{"b", "c"}) || !c.done["a"] {
+		t.Errorf("queue %v, done %v, want [b c] queued and a done", c.queue, c.done)
+	}
+}
+
+func TestCoordinatorRestore(t *testing.T) {
+	state := &CrawlState{
+		Site: "coordinatortest",
+		// a записан, b обработан, но товара в файле нет, c - не товар
+		Done:  []string{"a", "b", "c"},
+		Empty: []string{"c"},
+		// d записан до сохранения состояния, a уже обработан
+		Queued:   []string{"d", "e", "a"},
+		Attempts: map[string]int{"e": 1},
+	}
+	c := newTestCoordinator(nil)
+	c.Restore(state, map[string]bool{"a": true, "d": true})
+
+	if !reflect.DeepEqual(c.queue, []string{"e", "b"}) {
+		t.Errorf("queue %v, want [e b]", c.queue)
+	}
+	restored := c.State()
+	if want := []string{"a", "c", "d"}; !reflect.DeepEqual(sorted(restored.Done), want) {
+		t.Errorf("done %v, want %v", sorted(restored.Done), want)
+	}
+	if want := []string{"c"}; !reflect.DeepEqual(restored.Empty, want) {
+		t.Errorf("empty %v, want %v", restored.Empty, want)
+	}
+	if restored.Attempts["e"] != 1 {
+		t.Errorf("attempts %v, want e: 1", restored.Attempts)
+	}
+
+	// Выданные адреса сохраняются как очередь
+	c.lease("w1")
+	if want := []string{"b", "e"}; !reflect.DeepEqual(sorted(c.State().Queued), want) {
+		t.Errorf("queued with lease %v, want %v", sorted(c.State().Queued), want)
+	}
+}
+
+func TestCoordinatorFinished(t *testing.T) {
+	c := newTestCoordinator(nil, "a")
+	lease := c.lease("w1")
+	c.checkFinished()
+	select {
+	case <-c.Finished():
+		t.Fatal("finished with an active lease")
+	default:
+	}
+	if err := c.report(&LeaseReport{Lease: lease.Id, Worker: "w1", Results: []*UrlResult{{Url: "a", Product: &Product{Name: "A"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Finished():
+	default:
+		t.Error("not finished after the last report")
+	}
+}
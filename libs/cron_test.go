@@ -0,0 +1,92 @@
+package libs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	cases := []struct {
+		field    string
+		min, max int
+		want     []int
+	}{
+		{"*", 0, 5, []int{0, 1, 2, 3, 4, 5}},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"1-5", 0, 59, []int{1, 2, 3, 4, 5}},
+		{"10-20/5", 0, 59, []int{10, 15, 20}},
+		{"5/20", 0, 59, []int{5, 25, 45}},
+		{"1,3,5", 0, 59, []int{1, 3, 5}},
+		{"1-2,10,20-30/10", 0, 59, []int{1, 2, 10, 20, 30}},
+	}
+	for _, c := range cases {
+		got, err := parseCronField(c.field, c.min, c.max)
+		if err != nil {
+			t.Errorf("%q: %v", c.field, err)
+			continue
+		}
+		var want uint64
+		for _, v := range c.want {
+			want |= 1 << uint(v)
+		}
+		if got != want {
+			t.Errorf("%q = %b, want %b", c.field, got, want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"* * * *",
+		"60 * * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"x * * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(month time.Month, day int, hour int, minute int) (time.Time) {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	// 2026-10-19 - понедельник
+	cases := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", at(10, 19, 10, 7), at(10, 19, 10, 15)},
+		{"*/15 * * * *", at(10, 19, 10, 15), at(10, 19, 10, 30)},
+		{"30 8,20 * * *", at(10, 19, 9, 0), at(10, 19, 20, 30)},
+		{"0 3 * * 1-5", at(10, 17, 12, 0), at(10, 19, 3, 0)},
+		{"0 0 * * 7", at(10, 19, 0, 0), at(10, 25, 0, 0)},
+		{"@monthly", at(10, 19, 0, 0), at(11, 1, 0, 0)},
+		{"@daily", at(12, 31, 23, 59), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Оба поля дней ограничены - подходит любое: 13-е или пятница
+		{"0 0 13 * 5", at(10, 10, 0, 0), at(10, 13, 0, 0)},
+		{"0 0 13 * 5", at(10, 13, 0, 0), at(10, 16, 0, 0)},
+		{"0 12 1-7 * 1", at(10, 19, 13, 0), at(10, 26, 12, 0)},
+		// */2 - без ограничения, как *, поэтому нужны оба: нечетное число
+		// и понедельник
+		{"0 3 */2 * 1", at(10, 1, 0, 0), at(10, 5, 3, 0)},
+		{"0 3 */2 * 1", at(10, 5, 3, 0), at(10, 19, 3, 0)},
+		{"0 0 31 2 *", at(10, 19, 0, 0), time.Time{}},
+	}
+	for _, c := range cases {
+		s, err := ParseSchedule(c.spec)
+		if err != nil {
+			t.Errorf("%q: %v", c.spec, err)
+			continue
+		}
+		if got := s.Next(c.from); !got.Equal(c.want) {
+			t.Errorf("%q after %s = %s, want %s", c.spec, c.from, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package libs
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"sort"
+	"strings"
+)
+
+func (p *Product) addAlias(u string) {
+	if u == p.Url {
+		return
+	}
+	for _, alias := range p.Aliases {
+		if alias == u {
+			return
+		}
+	}
+	p.Aliases = append(p.Aliases, u)
+}
+
+// ProductFingerprint - хеш содержимого товара без адреса: название,
+// артикул, цена, описание, характеристики и картинки. У страниц одного
+// товара под разными адресами он совпадает. Товар без названия
+// отпечатка не имеет.
+func ProductFingerprint(p *Product) (string) {
+	norm := func(s string) (string) {
+		return strings.ToLower(strings.Join(strings.Fields(s), " "))
+	}
+	if norm(p.Name) == "" {
+		return ""
+	}
+	attributes := make([]string, 0, len(p.Attributes))
+	for _, a := range p.Attributes {
+		attributes = append(attributes, norm(a.Group)+"\x00"+norm(a.Key)+"\x00"+norm(a.Value))
+	}
+	sort.Strings(attributes)
+	images := append([]string(nil), p.Images...)
+	sort.Strings(images)
+
+	h := sha1.New()
+	for _, part := range []string{p.Site, norm(p.Name), norm(p.Article), norm(p.Price), norm(p.Description)} {
+		h.Write([]byte(part + "\xff"))
+	}
+	h.Write([]byte(strings.Join(attributes, "\x01") + "\xff"))
+	h.Write([]byte(strings.Join(images, "\x01")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DedupeProducts склеивает товары с одинаковым адресом или одинаковым
+// содержимым: остается первый, адреса остальных уходят в его Aliases.
+// Возвращает оставшиеся товары в исходном порядке и число склеенных.
+func DedupeProducts(products []*Product) ([]*Product, int) {
+	duplicates := NewDuplicateFilter()
+	kept := make([]*Product, 0, len(products))
+	for _, p := range products {
+		if _, _, ok := duplicates.Merge(p); !ok {
+			kept = append(kept, p)
+		}
+	}
+	return kept, len(products) - len(kept)
+}
+
+// DedupeFile склеивает дубли в файле товаров. Файл переписывается через
+// временный, только если было что склеить.
+func DedupeFile(ctx context.Context, filename string) (error) {
+	products, err := OpenProducts(filename)
+	if err != nil {
+		return err
+	}
+	kept, merged := DedupeProducts(products)
+	if merged == 0 {
+		return nil
+	}
+
+	w, err := CreateProductWriter(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	for _, p := range kept {
+		if err := w.Write(p); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	L(ctx).Info("duplicates merged", "file", filename, "products", len(kept), "merged", merged)
+	return os.Rename(filename+".tmp", filename)
+}
+
+// DuplicateFilter склеивает товары по мере разбора: и потоковые файлы
+// товаров, и каталоги стадий, где запись каталога надо дополнить
+// адресами склеенного дубля.
+type DuplicateFilter struct {
+	kept      []*Product
+	byUrl     map[string]int
+	byContent map[string]int
+}
+
+func NewDuplicateFilter() (*DuplicateFilter) {
+	return &DuplicateFilter{byUrl: make(map[string]int), byContent: make(map[string]int)}
+}
+
+// Merge склеивает p с уже встреченным товаром с тем же адресом или
+// содержимым: адреса p уходят в Aliases первого. Для дубля возвращает
+// первый товар, его номер среди оставленных и true. Иначе p оставляется
+// под следующим номером.
+func (f *DuplicateFilter) Merge(p *Product) (*Product, int, bool) {
+	first, ok := -1, false
+	if p.Url != "" {
+		first, ok = f.byUrl[p.Url]
+	}
+	fingerprint := ProductFingerprint(p)
+	if !ok && fingerprint != "" {
+		first, ok = f.byContent[fingerprint]
+	}
+	if !ok {
+		i := len(f.kept)
+		f.kept = append(f.kept, p)
+		for _, u := range append([]string{p.Url}, p.Aliases...) {
+			if u != "" {
+				f.byUrl[u] = i
+			}
+		}
+		if fingerprint != "" {
+			f.byContent[fingerprint] = i
+		}
+		return nil, -1, false
+	}
+
+	kept := f.kept[first]
+	for _, u := range append([]string{p.Url}, p.Aliases...) {
+		if u != "" {
+			kept.addAlias(u)
+			f.byUrl[u] = first
+		}
+	}
+	return kept, first, true
+}
@@ -0,0 +1,135 @@
+package libs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProductFingerprint(t *testing.T) {
+	p := &Product{Site: "s", Url: "http://x/1", Name: "Дрель  Makita", Images: []string{"b.jpg", "a.jpg"}}
+	p.AddAttribute("", "Мощность", "600 Вт")
+	p.AddAttribute("", "Вес", "2 кг")
+
+	same := &Product{Site: "s", Url: "http://x/2", Name: "дрель makita", Images: []string{"a.jpg", "b.jpg"}}
+	same.AddAttribute("", "Вес", "2  кг")
+	same.AddAttribute("", "мощность", "600 Вт")
+
+	cases := []struct {
+		name  string
+		other *Product
+		equal bool
+	}{
+		{"other url, case, spaces and order", same, true},
+		{"other price", &Product{Site: "s", Name: "Дрель Makita", Price: "100", Images: p.Images, Attributes: p.Attributes}, false},
+		{"other site", &Product{Site: "t", Name: "Дрель Makita", Images: p.Images, Attributes: p.Attributes}, false},
+	}
+	for _, c := range cases {
+		if equal := ProductFingerprint(p) == ProductFingerprint(c.other); equal != c.equal {
+			t.Errorf("%s: equal %v, want %v", c.name, equal, c.equal)
+		}
+	}
+	if fp := ProductFingerprint(&Product{Site: "s", Url: "http://x/3"}); fp != "" {
+		t.Errorf("fingerprint without name %q, want empty", fp)
+	}
+}
+
+func TestDuplicateFilterMerge(t *testing.T) {
+	type merged struct {
+		index int
+		ok    bool
+	}
+	cases := []struct {
+		name     string
+		products []*Product
+		merged   []merged
+		aliases  [][]string
+	}{
+		{
+			name: "distinct",
+			products: []*Product{
+				{Site: "s", Url: "http://x/1", Name: "A"},
+				{Site: "s", Url: "http://x/2", Name: "B"},
+			},
+			merged:  []merged{{-1, false}, {-1, false}},
+			aliases: [][]string{nil, nil},
+		},
+		{
+			name: "same url",
+			products: []*Product{
+				{Site: "s", Url: "http://x/1", Name: "A"},
+				{Site: "s", Url: "http://x/1", Name: "A, new price", Price: "10"},
+			},
+			merged:  []merged{{-1, false}, {0, true}},
+			aliases: [][]string{nil},
+		},
+		{
+			name: "url is a known alias",
+			products: []*Product{
+				{Site: "s", Url: "http://x/1", Aliases: []string{"http://x/old"}, Name: "A"},
+				{Site: "s", Url: "http://x/2", Name: "B"},
+				{Site: "s", Url: "http://x/old", Name: "A, old page", Aliases: []string{"http://x/older"}},
+			},
+			merged:  []merged{{-1, false}, {-1, false}, {0, true}},
+			aliases: [][]string{{"http://x/old", "http://x/older"}, nil},
+		},
+		{
+			name: "same content",
+			products: []*Product{
+				{Site: "s", Url: "http://x/1", Name: "A"},
+				{Site: "s", Url: "http://x/2", Name: "B"},
+				{Site: "s", Url: "http://x/3", Name: "b"},
+				{Site: "s", Url: "http://x/3", Name: "other"},
+			},
+			merged:  []merged{{-1, false}, {-1, false}, {1, true}, {1, true}},
+			aliases: [][]string{nil, {"http://x/3"}},
+		},
+		{
+			name: "no name no content match",
+			products: []*Product{
+				{Site: "s", Url: "http://x/1"},
+				{Site: "s", Url: "http://x/2"},
+			},
+			merged:  []merged{{-1, false}, {-1, false}},
+			aliases: [][]string{nil, nil},
+		},
+	}
+	for _, c := range cases {
+		f := NewDuplicateFilter()
+		for i, p := range c.products {
+			kept, index, ok := f.Merge(p)
+			if index != c.merged[i].index || ok != c.merged[i].ok {
+				t.Errorf("%s: product %d merged into %d, %v, want %d, %v", c.name, i, index, ok, c.merged[i].index, c.merged[i].ok)
+			}
+			if ok && kept != f.kept[index] {
+				t.Errorf("%s: product %d merged into a product that is not kept", c.name, i)
+			}
+		}
+		if len(f.kept) != len(c.aliases) {
+			t.Errorf("%s: %d kept, want %d", c.name, len(f.kept), len(c.aliases))
+			continue
+		}
+		for i, p := range f.kept {
+			if len(p.Aliases) == 0 && len(c.aliases[i]) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(p.Aliases, c.aliases[i]) {
+				t.Errorf("%s: kept %d aliases %v, want %v", c.name, i, p.Aliases, c.aliases[i])
+			}
+		}
+	}
+}
+
+func TestDedupeProducts(t *testing.T) {
+	products := []*Product{
+		{Site: "s", Url: "http://x/1", Name: "A"},
+		{Site: "s", Url: "http://x/2", Name: "B"},
+		{Site: "s", Url: "http://x/1?dup", Name: "a"},
+	}
+	kept, merged := DedupeProducts(products)
+	if merged != 1 || len(kept) != 2 || kept[0] != products[0] || kept[1] != products[1] {
+		t.Fatalf("kept %v, merged %d, want the first two and 1 merged", kept, merged)
+	}
+	if want := []string{"http://x/1?dup"}; !reflect.DeepEqual(kept[0].Aliases, want) {
+		t.Errorf("aliases %v, want %v", kept[0].Aliases, want)
+	}
+}
@@ -0,0 +1,393 @@
+package libs
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CatalogDiff - что изменилось в каталоге сайта между двумя запусками.
+type CatalogDiff struct {
+	Site     string           `json:"site"`
+	Time     time.Time        `json:"time"`
+	Old      string           `json:"old"`
+	New      string           `json:"new"`
+	OldCount int              `json:"oldCount"`
+	NewCount int              `json:"newCount"`
+	Added    []*DiffProduct   `json:"added"`
+	Removed  []*DiffProduct   `json:"removed"`
+	Changed  []*ProductChange `json:"changed"`
+	// Пары, сопоставленные только по имени: переименование такого товара
+	// выглядит как удаление и добавление
+	NameOnly int `json:"nameOnly,omitempty"`
+}
+
+// DiffProduct - товар в отчете: чем сопоставлен и как его найти.
+type DiffProduct struct {
+	// url:..., article:... или name:... - по чему товары сопоставлены
+	Key   string `json:"key"`
+	Name  string `json:"name"`
+	Url   string `json:"url,omitempty"`
+	Price string `json:"price,omitempty"`
+}
+
+type ProductChange struct {
+	DiffProduct
+	Price      *PriceChange       `json:"price,omitempty"`
+	Fields     []*FieldChange     `json:"fields,omitempty"`
+	Attributes []*AttributeChange `json:"attributes,omitempty"`
+	Images     *ImagesChange      `json:"images,omitempty"`
+}
+
+// PriceChange - Delta и Percent заполнены, если обе цены разобрались как числа.
+type PriceChange struct {
+	Old     string   `json:"old"`
+	New     string   `json:"new"`
+	Delta   *float64 `json:"delta,omitempty"`
+	Percent *float64 `json:"percent,omitempty"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// AttributeChange - пустой Old значит новую характеристику, пустой New - пропавшую.
+type AttributeChange struct {
+	Group string `json:"group,omitempty"`
+	Key   string `json:"key"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+type ImagesChange struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// ParsePrice разбирает цену вида "12 990 руб." или "1 299,50".
+func ParsePrice(s string) (float64, bool) {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ',' || r == '.':
+			b.WriteRune('.')
+		}
+	}
+	clean := strings.Trim(b.String(), ".")
+	if clean == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(clean, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+func diffProduct(key string, p *Product) (*DiffProduct) {
+	return &DiffProduct{Key: key, Name: p.Name, Url: p.Url, Price: p.Price}
+}
+
+// productKeys - ключи товара в порядке надежности: адрес, артикул, имя.
+// В каталогах без адресов и артикулов остается только имя.
+func productKeys(p *Product) ([]string) {
+	keys := make([]string, 0, 3)
+	if url := strings.TrimSpace(p.Url); url != "" {
+		keys = append(keys, "url:"+url)
+	}
+	if article := strings.TrimSpace(p.Article); article != "" {
+		keys = append(keys, "article:"+article)
+	}
+	if name := strings.TrimSpace(p.Name); name != "" {
+		keys = append(keys, "name:"+name)
+	}
+	return keys
+}
+
+// DiffCatalogs сопоставляет товары старого и нового каталога по адресу,
+// затем по артикулу, затем по имени, и сравнивает пары.
+func DiffCatalogs(site string, before []*Product, after []*Product) (*CatalogDiff) {
+	d := &CatalogDiff{
+		Site:     site,
+		Time:     time.Now(),
+		OldCount: len(before),
+		NewCount: len(after),
+		Added:    make([]*DiffProduct, 0),
+		Removed:  make([]*DiffProduct, 0),
+		Changed:  make([]*ProductChange, 0),
+	}
+
+	index := make(map[string][]int)
+	for i, p := range before {
+		for _, key := range productKeys(p) {
+			index[key] = append(index[key], i)
+		}
+	}
+	matched := make([]bool, len(before))
+	take := func(key string) (int) {
+		for _, i := range index[key] {
+			if !matched[i] {
+				matched[i] = true
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, p := range after {
+		keys := productKeys(p)
+		found := -1
+		foundKey := ""
+		for _, key := range keys {
+			if found = take(key); found >= 0 {
+				foundKey = key
+				break
+			}
+		}
+		if found < 0 {
+			key := ""
+			if len(keys) > 0 {
+				key = keys[0]
+			}
+			d.Added = append(d.Added, diffProduct(key, p))
+			continue
+		}
+		if strings.HasPrefix(foundKey, "name:") {
+			d.NameOnly++
+		}
+		if change := diffPair(foundKey, before[found], p); change != nil {
+			d.Changed = append(d.Changed, change)
+		}
+	}
+	for i, p := range before {
+		if matched[i] {
+			continue
+		}
+		key := ""
+		if keys := productKeys(p); len(keys) > 0 {
+			key = keys[0]
+		}
+		d.Removed = append(d.Removed, diffProduct(key, p))
+	}
+	return d
+}
+
+// diffPair возвращает nil, если товар не изменился.
+func diffPair(key string, before *Product, after *Product) (*ProductChange) {
+	c := &ProductChange{DiffProduct: *diffProduct(key, after)}
+	changed := false
+
+	if strings.TrimSpace(before.Price) != strings.TrimSpace(after.Price) {
+		c.Price = &PriceChange{Old: before.Price, New: after.Price}
+		o, ok1 := ParsePrice(before.Price)
+		n, ok2 := ParsePrice(after.Price)
+		if ok1 && ok2 {
+			delta := n - o
+			c.Price.Delta = &delta
+			if o != 0 {
+				percent := math.Round(delta/o*10000) / 100
+				c.Price.Percent = &percent
+			}
+		}
+		changed = true
+	}
+
+	fields := []struct {
+		name, before, after string
+	}{
+		{"name", before.Name, after.Name},
+		{"shortName", before.ShortName, after.ShortName},
+		{"article", before.Article, after.Article},
+		{"collection", before.Collection, after.Collection},
+		{"availability", before.Availability, after.Availability},
+		{"description", before.Description, after.Description},
+	}
+	for _, f := range fields {
+		if strings.TrimSpace(f.before) != strings.TrimSpace(f.after) {
+			c.Fields = append(c.Fields, &FieldChange{Field: f.name, Old: f.before, New: f.after})
+			changed = true
+		}
+	}
+
+	if c.Attributes = diffAttributes(before.Attributes, after.Attributes); len(c.Attributes) > 0 {
+		changed = true
+	}
+
+	images := diffImages(before.Images, after.Images)
+	if len(images.Added) > 0 || len(images.Removed) > 0 {
+		c.Images = images
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return c
+}
+
+func diffAttributes(before []*ProductAttribute, after []*ProductAttribute) ([]*AttributeChange) {
+	type attrKey struct{ group, key string }
+	oldValues := make(map[attrKey]string)
+	for _, a := range before {
+		oldValues[attrKey{a.Group, a.Key}] = strings.TrimSpace(a.Value)
+	}
+	changes := make([]*AttributeChange, 0)
+	seen := make(map[attrKey]bool)
+	for _, a := range after {
+		k := attrKey{a.Group, a.Key}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		value := strings.TrimSpace(a.Value)
+		if oldValue, ok := oldValues[k]; !ok || oldValue != value {
+			changes = append(changes, &AttributeChange{Group: a.Group, Key: a.Key, Old: oldValue, New: value})
+		}
+	}
+	for _, a := range before {
+		k := attrKey{a.Group, a.Key}
+		if !seen[k] {
+			seen[k] = true
+			changes = append(changes, &AttributeChange{Group: a.Group, Key: a.Key, Old: strings.TrimSpace(a.Value)})
+		}
+	}
+	return changes
+}
+
+func diffImages(before []string, after []string) (*ImagesChange) {
+	c := new(ImagesChange)
+	had := make(map[string]bool)
+	for _, image := range before {
+		had[image] = true
+	}
+	has := make(map[string]bool)
+	for _, image := range after {
+		has[image] = true
+		if !had[image] {
+			c.Added = append(c.Added, image)
+		}
+	}
+	for _, image := range before {
+		if !has[image] {
+			c.Removed = append(c.Removed, image)
+			has[image] = true
+		}
+	}
+	return c
+}
+
+func (d *CatalogDiff) Empty() (bool) {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d *CatalogDiff) Save(filename string) (error) {
+	b, err := json.MarshalIndent(d, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// WriteSummary пишет отчет для человека: счетчики и по строке на изменение.
+func (d *CatalogDiff) WriteSummary(w io.Writer) {
+	priced := 0
+	for _, c := range d.Changed {
+		if c.Price != nil {
+			priced++
+		}
+	}
+	fmt.Fprintf(w, "%s: %d -> %d products, %d added, %d removed, %d changed (%d price)\n",
+		d.Site, d.OldCount, d.NewCount, len(d.Added), len(d.Removed), len(d.Changed), priced)
+	if d.NameOnly > 0 {
+		fmt.Fprintf(w, "warning: %d products are matched by name only, with no common url or article, a renamed product shows as removed and added\n", d.NameOnly)
+	}
+
+	for _, p := range d.Added {
+		fmt.Fprintf(w, "+ %s%s\n", p.Name, pricePart(p.Price))
+	}
+	for _, p := range d.Removed {
+		fmt.Fprintf(w, "- %s%s\n", p.Name, pricePart(p.Price))
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(w, "~ %s\n", c.Name)
+		if c.Price != nil {
+			line := fmt.Sprintf("    price: %s -> %s", c.Price.Old, c.Price.New)
+			if c.Price.Delta != nil {
+				line += fmt.Sprintf(" (%+g", *c.Price.Delta)
+				if c.Price.Percent != nil {
+					line += fmt.Sprintf(", %+g%%", *c.Price.Percent)
+				}
+				line += ")"
+			}
+			fmt.Fprintln(w, line)
+		}
+		for _, f := range c.Fields {
+			fmt.Fprintf(w, "    %s: %s -> %s\n", f.Field, shorten(f.Old, 60), shorten(f.New, 60))
+		}
+		for _, a := range c.Attributes {
+			name := a.Key
+			if a.Group != "" {
+				name = a.Group + "/" + a.Key
+			}
+			switch {
+			case a.Old == "" && a.New != "":
+				fmt.Fprintf(w, "    + %s: %s\n", name, a.New)
+			case a.New == "" && a.Old != "":
+				fmt.Fprintf(w, "    - %s: %s\n", name, a.Old)
+			default:
+				fmt.Fprintf(w, "    %s: %s -> %s\n", name, a.Old, a.New)
+			}
+		}
+		if c.Images != nil {
+			fmt.Fprintf(w, "    images: +%d -%d\n", len(c.Images.Added), len(c.Images.Removed))
+		}
+	}
+}
+
+func pricePart(price string) (string) {
+	if price == "" {
+		return ""
+	}
+	return " (" + price + ")"
+}
+
+// shorten обрезает длинные значения вроде описаний для сводки.
+func shorten(s string, n int) (string) {
+	s = strings.Join(strings.Fields(s), " ")
+	r := []rune(s)
+	if len(r) <= n {
+		return strconv.Quote(s)
+	}
+	return strconv.Quote(string(r[:n]) + "...")
+}
+
+// IsProductsFile сообщает, записан ли файл ProductWriter, а не в формате
+// каталога конкретного сайта: смотрит на корневой элемент.
+func IsProductsFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	d := xml.NewDecoder(f)
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", filename, err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local == "products", nil
+		}
+	}
+}
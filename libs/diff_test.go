@@ -0,0 +1,157 @@
+package libs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePrice(t *testing.T) {
+	cases := []struct {
+		s    string
+		want float64
+		ok   bool
+	}{
+		{"12 990 руб.", 12990, true},
+		{"1 299,50", 1299.5, true},
+		{"45990", 45990, true},
+		{"", 0, false},
+		{"руб.", 0, false},
+	}
+	for _, c := range cases {
+		got, ok := ParsePrice(c.s)
+		if got != c.want || ok != c.ok {
+			t.Errorf("ParsePrice(%q) = %v, %v, want %v, %v", c.s, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestDiffCatalogs(t *testing.T) {
+	cases := []struct {
+		name     string
+		before   []*Product
+		after    []*Product
+		added    []string
+		removed  []string
+		changed  []string
+		nameOnly int
+	}{
+		{
+			name:   "same",
+			before: []*Product{{Url: "http://x/1", Name: "Drill", Price: "100"}},
+			after:  []*Product{{Url: "http://x/1", Name: "Drill", Price: "100"}},
+		},
+		{
+			name:    "renamed by url",
+			before:  []*Product{{Url: "http://x/1", Name: "Drill"}},
+			after:   []*Product{{Url: "http://x/1", Name: "Drill 2"}},
+			changed: []string{"url:http://x/1"},
+		},
+		{
+			name:    "moved by article",
+			before:  []*Product{{Url: "http://x/1", Article: "A1", Name: "Drill"}},
+			after:   []*Product{{Url: "http://x/2", Article: "A1", Name: "Drill", Price: "10"}},
+			changed: []string{"article:A1"},
+		},
+		{
+			name:     "matched by name",
+			before:   []*Product{{Name: "Drill", Price: "100"}},
+			after:    []*Product{{Name: "Drill", Price: "90"}},
+			changed:  []string{"name:Drill"},
+			nameOnly: 1,
+		},
+		{
+			name:    "renamed without url",
+			before:  []*Product{{Name: "Drill"}},
+			after:   []*Product{{Name: "Drill 2"}},
+			added:   []string{"Drill 2"},
+			removed: []string{"Drill"},
+		},
+		{
+			name:    "added and removed",
+			before:  []*Product{{Url: "http://x/1", Name: "Drill"}, {Url: "http://x/2", Name: "Saw"}},
+			after:   []*Product{{Url: "http://x/1", Name: "Drill"}, {Url: "http://x/3", Name: "Hammer"}},
+			added:   []string{"Hammer"},
+			removed: []string{"Saw"},
+		},
+		{
+			name: "attributes and images",
+			before: []*Product{{Url: "http://x/1", Name: "Drill", Images: []string{"a.jpg"},
+				Attributes: []*ProductAttribute{{Key: "Power", Value: "500"}}}},
+			after: []*Product{{Url: "http://x/1", Name: "Drill", Images: []string{"b.jpg"},
+				Attributes: []*ProductAttribute{{Key: "Power", Value: "600"}}}},
+			changed: []string{"url:http://x/1"},
+		},
+	}
+	names := func(products []*DiffProduct) ([]string) {
+		s := make([]string, 0)
+		for _, p := range products {
+			s = append(s, p.Name)
+		}
+		return s
+	}
+	for _, c := range cases {
+		d := DiffCatalogs("test", c.before, c.after)
+		changed := make([]string, 0)
+		for _, change := range d.Changed {
+			changed = append(changed, change.Key)
+		}
+		if c.added == nil {
+			c.added = []string{}
+		}
+		if c.removed == nil {
+			c.removed = []string{}
+		}
+		if c.changed == nil {
+			c.changed = []string{}
+		}
+		if got := names(d.Added); !reflect.DeepEqual(got, c.added) {
+			t.Errorf("%s: added %v, want %v", c.name, got, c.added)
+		}
+		if got := names(d.Removed); !reflect.DeepEqual(got, c.removed) {
+			t.Errorf("%s: removed %v, want %v", c.name, got, c.removed)
+		}
+		if !reflect.DeepEqual(changed, c.changed) {
+			t.Errorf("%s: changed %v, want %v", c.name, changed, c.changed)
+		}
+		if d.NameOnly != c.nameOnly {
+			t.Errorf("%s: nameOnly %d, want %d", c.name, d.NameOnly, c.nameOnly)
+		}
+	}
+}
+
+func TestDiffPair(t *testing.T) {
+	before := &Product{Url: "http://x/1", Name: "Drill", Price: "1 000 руб.", Availability: "InStock",
+		Attributes: []*ProductAttribute{{Key: "Power", Value: "500"}, {Key: "Color", Value: "red"}},
+		Images:     []string{"a.jpg", "b.jpg"}}
+	after := &Product{Url: "http://x/1", Name: "Drill", Price: "1 100 руб.", Availability: "OutOfStock",
+		Attributes: []*ProductAttribute{{Key: "Power", Value: "600"}, {Key: "Weight", Value: "2"}},
+		Images:     []string{"b.jpg", "c.jpg"}}
+
+	c := diffPair("url:http://x/1", before, after)
+	if c == nil {
+		t.Fatal("no change found")
+	}
+	if c.Price == nil || c.Price.Delta == nil || *c.Price.Delta != 100 || c.Price.Percent == nil || *c.Price.Percent != 10 {
+		t.Errorf("price change %+v, want +100, +10%%", c.Price)
+	}
+	wantFields := []*FieldChange{{Field: "availability", Old: "InStock", New: "OutOfStock"}}
+	if !reflect.DeepEqual(c.Fields, wantFields) {
+		t.Errorf("fields %+v, want %+v", c.Fields, wantFields)
+	}
+	wantAttributes := []*AttributeChange{
+		{Key: "Power", Old: "500", New: "600"},
+		{Key: "Weight", New: "2"},
+		{Key: "Color", Old: "red"},
+	}
+	if !reflect.DeepEqual(c.Attributes, wantAttributes) {
+		t.Errorf("attributes %+v, want %+v", c.Attributes, wantAttributes)
+	}
+	wantImages := &ImagesChange{Added: []string{"c.jpg"}, Removed: []string{"a.jpg"}}
+	if !reflect.DeepEqual(c.Images, wantImages) {
+		t.Errorf("images %+v, want %+v", c.Images, wantImages)
+	}
+
+	if c := diffPair("url:http://x/1", before, before); c != nil {
+		t.Errorf("unchanged product reported as %+v", c)
+	}
+}
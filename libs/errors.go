@@ -0,0 +1,212 @@
+package libs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type ErrorKind string
+
+const (
+	// Страницу не удалось скачать или открыть
+	ErrorFetch ErrorKind = "fetch"
+	// Страница не разбирается как HTML
+	ErrorDecode ErrorKind = "decode"
+	// Страница не является карточкой товара
+	ErrorNotProduct ErrorKind = "not-a-product"
+	// У товара не найдено обязательное поле
+	ErrorMissingField ErrorKind = "missing-field"
+)
+
+type PageError struct {
+	Kind  ErrorKind
+	File  string
+	Url   string
+	Field string
+	Err   error
+}
+
+func (e *PageError) Error() string {
+	s := string(e.Kind) + ": " + e.File
+	if e.Field != "" {
+		s += ": " + e.Field
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Конструкторы ошибок получают и файл страницы, и ее адрес, чтобы отчет
+// об ошибках вел обратно на сайт. Для страниц без файла это один адрес.
+func FetchError(file string, url string, err error) (*PageError) {
+	return &PageError{Kind: ErrorFetch, File: file, Url: url, Err: err}
+}
+
+func DecodeError(file string, url string, err error) (*PageError) {
+	return &PageError{Kind: ErrorDecode, File: file, Url: url, Err: err}
+}
+
+func NotProductError(file string, url string, reason string) (*PageError) {
+	return &PageError{Kind: ErrorNotProduct, File: file, Url: url, Err: fmt.Errorf("%s", reason)}
+}
+
+func MissingFieldError(file string, url string, field string) (*PageError) {
+	return &PageError{Kind: ErrorMissingField, File: file, Url: url, Field: field}
+}
+
+// IsNotProduct сообщает, что страница просто не товар. Такие страницы
+// пропускаются и не попадают в карантин.
+func IsNotProduct(err error) (bool) {
+	pe, ok := err.(*PageError)
+	return ok && pe.Kind == ErrorNotProduct
+}
+
+type ReportEntry struct {
+	Kind        ErrorKind `xml:"kind" json:"kind"`
+	File        string    `xml:"file" json:"file"`
+	Url         string    `xml:"url,omitempty" json:"url,omitempty"`
+	Field       string    `xml:"field,omitempty" json:"field,omitempty"`
+	Message     string    `xml:"message" json:"message"`
+	Quarantined string    `xml:"quarantined,omitempty" json:"quarantined,omitempty"`
+}
+
+type ReportCount struct {
+	Kind  ErrorKind `xml:"kind,attr" json:"kind"`
+	Count int       `xml:",chardata" json:"count"`
+}
+
+// ParseReport собирает ошибки разбора по страницам за один этап.
+type ParseReport struct {
+	XMLName     xml.Name       `xml:"parseReport" json:"-"`
+	Site        string         `xml:"site" json:"site"`
+	Stage       string         `xml:"stage" json:"stage"`
+	Run         string         `xml:"run,omitempty" json:"run,omitempty"`
+	Started     time.Time      `xml:"started" json:"started"`
+	Finished    time.Time      `xml:"finished" json:"finished"`
+	Total       int            `xml:"total" json:"total"`
+	Parsed      int            `xml:"parsed" json:"parsed"`
+	NotProducts int            `xml:"notProducts,omitempty" json:"notProducts,omitempty"`
+	Counts      []*ReportCount `xml:"counts>count" json:"counts"`
+	Errors      []*ReportEntry `xml:"errors>error" json:"errors"`
+}
+
+// NewParseReport заводит отчет этапа stage запуска run, см. RunOf.
+func NewParseReport(site string, stage string, run string) (*ParseReport) {
+	return &ParseReport{Site: site, Stage: stage, Run: run, Started: time.Now(), Errors: make([]*ReportEntry, 0)}
+}
+
+func (r *ParseReport) Ok() {
+	r.Total++
+	r.Parsed++
+	ParseResults.Inc(r.Site, r.Stage, "ok")
+}
+
+// NotProduct учитывает страницу, которая просто не товар: она
+// считается отдельно и в Errors не попадает.
+func (r *ParseReport) NotProduct(file string) {
+	r.Total++
+	r.NotProducts++
+	ParseResults.Inc(r.Site, r.Stage, string(ErrorNotProduct))
+}
+
+// Add учитывает ошибку страницы. Ошибки не типа PageError считаются
+// ошибками разбора для файла file.
+func (r *ParseReport) Add(file string, err error) {
+	r.Total++
+	pe, ok := err.(*PageError)
+	if !ok {
+		pe = DecodeError(file, PageUrl(file), err)
+	}
+	entry := &ReportEntry{Kind: pe.Kind, File: pe.File, Url: pe.Url, Field: pe.Field, Message: pe.Error()}
+	if entry.File == "" {
+		entry.File = file
+	}
+	r.Errors = append(r.Errors, entry)
+	ParseResults.Inc(r.Site, r.Stage, string(pe.Kind))
+}
+
+// Quarantine копирует страницы с ошибками (кроме "не товар") в dir,
+// чтобы их можно было разобрать руками или превратить в фикстуры.
+func (r *ParseReport) Quarantine(dir string) (error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var first error
+	for _, entry := range r.Errors {
+		if entry.Kind == ErrorNotProduct || entry.Kind == ErrorFetch {
+			continue
+		}
+		target := filepath.Join(dir, filepath.Base(entry.File))
+		if err := copyFile(entry.File, target); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		entry.Quarantined = target
+	}
+	return first
+}
+
+func (r *ParseReport) Save(filename string) (error) {
+	r.Finished = time.Now()
+
+	counts := make(map[ErrorKind]int)
+	for _, entry := range r.Errors {
+		counts[entry.Kind]++
+	}
+	r.Counts = make([]*ReportCount, 0, len(counts))
+	for kind, count := range counts {
+		r.Counts = append(r.Counts, &ReportCount{Kind: kind, Count: count})
+	}
+	sort.Slice(r.Counts, func(i, j int) bool { return r.Counts[i].Kind < r.Counts[j].Kind })
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	e := xml.NewEncoder(f)
+	e.Indent("", "\t")
+	return e.Encode(r)
+}
+
+// OpenParseReport возвращает nil без ошибки, если отчета еще нет.
+func OpenParseReport(filename string) (*ParseReport, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	report := new(ParseReport)
+	if err := xml.NewDecoder(f).Decode(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func copyFile(source string, target string) (error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,224 @@
+package libs
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FollowUp - дополнительный запрос за данными товара, которых нет в html:
+// наличие, сроки доставки, блоки, которые страница подгружает скриптом.
+// Парсер добавляет его к товару по id со страницы, а пайплайн, воркер
+// и проход по регионам выполняют и вызывают Merge с телом ответа.
+type FollowUp struct {
+	// Короткое имя для логов и метрик: "stock", "header"
+	Name  string
+	Url   string
+	Merge func(p *Product, body []byte) (error)
+}
+
+// AddFollowUp добавляет к товару дополнительный запрос.
+func (p *Product) AddFollowUp(name string, url string, merge func(p *Product, body []byte) (error)) {
+	p.FollowUps = append(p.FollowUps, &FollowUp{Name: name, Url: url, Merge: merge})
+}
+
+// MergeJSON - Merge для json ответа: тело разбирается в то, что вернет
+// target, и передается в merge.
+func MergeJSON(target func() (interface{}), merge func(p *Product, v interface{})) (func(p *Product, body []byte) (error)) {
+	return func(p *Product, body []byte) (error) {
+		v := target()
+		if err := json.Unmarshal(body, v); err != nil {
+			return err
+		}
+		merge(p, v)
+		return nil
+	}
+}
+
+// FollowUpFetcher выполняет дополнительные запросы товаров. Ответы на
+// одинаковые адреса за один запуск берутся из памяти. С Dir ответы
+// сохраняются на диск рядом со страницами, и повторный разбор тех же
+// страниц берет их оттуда, пока они не старше MaxAge.
+type FollowUpFetcher struct {
+	Site string
+	// Общий с загрузкой страниц лимит одновременных запросов, nil - без лимита
+	Limit chan struct{}
+	Dir   string
+	// Сколько ответов держать в памяти, 0 - не держать
+	CacheSize int
+	// Сколько сохраненный ответ годен: наличие и цены быстро устаревают
+	MaxAge time.Duration
+
+	m     sync.Mutex
+	cache map[string][]byte
+}
+
+// DefaultFollowUpMaxAge - сколько годен сохраненный ответ по умолчанию.
+const DefaultFollowUpMaxAge = 6 * time.Hour
+
+// Лимиты одновременных запросов по сайтам, см. SiteLimit
+var (
+	siteLimitsM sync.Mutex
+	siteLimits  = make(map[string]chan struct{})
+)
+
+// SiteLimit возвращает общий на процесс лимит одновременных запросов к
+// сайту: страницы и дополнительные запросы потока, воркера и прохода по
+// регионам занимают место в одном лимите. Размер задает первый вызов,
+// n < 1 - DefaultPipelineConfig.Fetchers.
+func SiteLimit(site string, n int) (chan struct{}) {
+	siteLimitsM.Lock()
+	defer siteLimitsM.Unlock()
+	limit, ok := siteLimits[site]
+	if !ok {
+		if n < 1 {
+			n = DefaultPipelineConfig.Fetchers
+		}
+		limit = make(chan struct{}, n)
+		siteLimits[site] = limit
+	}
+	return limit
+}
+
+// acquire занимает место в limit или ждет отмены ctx. nil - без лимита.
+// Место возвращает release.
+func acquire(ctx context.Context, limit chan struct{}) (error) {
+	if limit == nil {
+		return nil
+	}
+	select {
+	case limit <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func release(limit chan struct{}) {
+	if limit != nil {
+		<-limit
+	}
+}
+
+func NewFollowUpFetcher(site string, limit chan struct{}, dir string) (*FollowUpFetcher) {
+	return &FollowUpFetcher{Site: site, Limit: limit, Dir: dir, CacheSize: 10000, MaxAge: DefaultFollowUpMaxAge, cache: make(map[string][]byte)}
+}
+
+// Run выполняет запросы товара по порядку. Неудачный запрос не портит
+// товар: поля из html остаются, ошибка пишется в лог и метрики.
+// Возвращает число неудачных запросов.
+func (f *FollowUpFetcher) Run(ctx context.Context, product *Product) (int) {
+	failed := 0
+	for _, followUp := range product.FollowUps {
+		if ctx.Err() != nil {
+			return failed
+		}
+		err := f.run(ctx, product, followUp)
+		if err == nil {
+			ParseResults.Inc(f.Site, "followup", "ok")
+			continue
+		}
+		failed++
+		pe, ok := err.(*PageError)
+		if !ok {
+			pe = DecodeError(followUp.Url, followUp.Url, err)
+		}
+		ParseResults.Inc(f.Site, "followup", string(pe.Kind))
+		L(ctx).Warn("follow-up failed", "followUp", followUp.Name, "product", product.Url, "error", pe)
+	}
+	product.FollowUps = nil
+	return failed
+}
+
+func (f *FollowUpFetcher) run(ctx context.Context, product *Product, followUp *FollowUp) (error) {
+	body, err := f.fetch(ctx, followUp.Url)
+	if err != nil {
+		return FetchError(followUp.Url, followUp.Url, err)
+	}
+	if err := followUp.Merge(product, body); err != nil {
+		return DecodeError(followUp.Url, followUp.Url, err)
+	}
+	return nil
+}
+
+func (f *FollowUpFetcher) fetch(ctx context.Context, url string) ([]byte, error) {
+	f.m.Lock()
+	body, ok := f.cache[url]
+	f.m.Unlock()
+	if ok {
+		return body, nil
+	}
+	if body, ok := f.load(url); ok {
+		L(ctx).Debug("follow-up from disk", "url", url, "bytes", len(body))
+		f.remember(url, body)
+		return body, nil
+	}
+
+	if err := acquire(ctx, f.Limit); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	_, body, err := FetchPage(ctx, url, "")
+	release(f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	L(ctx).Debug("follow-up fetched", "url", url, "bytes", len(body), "duration", time.Since(started))
+
+	if f.Dir != "" {
+		if err := f.save(url, body); err != nil {
+			L(ctx).Warn("follow-up not saved", "url", url, "dir", f.Dir, "error", err)
+		}
+	}
+	f.remember(url, body)
+	return body, nil
+}
+
+func (f *FollowUpFetcher) remember(url string, body []byte) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if len(f.cache) < f.CacheSize {
+		f.cache[url] = body
+	}
+}
+
+// file - куда сохраняется ответ на url: Dir/xhr под хешем адреса.
+func (f *FollowUpFetcher) file(url string) (string) {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(f.Dir, "xhr", hex.EncodeToString(sum[:])+".json")
+}
+
+// load возвращает сохраненный ответ, если он есть и не старше MaxAge.
+func (f *FollowUpFetcher) load(url string) ([]byte, bool) {
+	if f.Dir == "" || f.MaxAge <= 0 {
+		return nil, false
+	}
+	file := f.file(url)
+	info, err := os.Stat(file)
+	if err != nil || time.Since(info.ModTime()) > f.MaxAge {
+		return nil, false
+	}
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// save кладет ответ в file(url), сам адрес - рядом, как у страниц.
+func (f *FollowUpFetcher) save(url string, body []byte) (error) {
+	file := f.file(url)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, body, 0644); err != nil {
+		return err
+	}
+	return savePageUrl(file, url)
+}
@@ -0,0 +1,229 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const (
+	FixtureExt = ".html"
+	GoldenExt  = ".golden.xml"
+)
+
+// FixturesDir возвращает testdata рядом с исходником, из которого ее
+// позвали, чтобы фикстуры находились независимо от текущего каталога.
+func FixturesDir() (string) {
+	_, file, _, ok := runtime.Caller(1)
+	if !ok {
+		return "testdata"
+	}
+	return filepath.Join(filepath.Dir(file), "testdata")
+}
+
+// ParseFunc разбирает сохраненную страницу в общий формат товара.
+// Страница, которая не карточка товара, дает NotProductError, и эталон
+// для нее пустой.
+type ParseFunc func(filename string) (*Product, error)
+
+// ParseReaderFunc разбирает страницу, скачанную с pageUrl, прямо из потока.
+// name используется в ошибках вместо имени файла.
+type ParseReaderFunc func(r io.Reader, pageUrl string, name string) (*Product, error)
+
+type GoldenResult struct {
+	Fixture string
+	Golden  string
+	Updated bool
+	Diff    string
+	Err     error
+}
+
+func (r *GoldenResult) Ok() bool {
+	return r.Err == nil && r.Diff == ""
+}
+
+// CheckGolden разбирает каждую *.html из dir и сравнивает результат
+// с соседним *.golden.xml. При update эталоны перезаписываются.
+func CheckGolden(dir string, parse ParseFunc, update bool) ([]*GoldenResult, error) {
+	fixtures, err := filepath.Glob(filepath.Join(dir, "*"+FixtureExt))
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*GoldenResult, 0)
+	for _, fixture := range fixtures {
+		results = append(results, checkFixture(fixture, parse, update))
+	}
+	return results, nil
+}
+
+func GoldenPath(fixture string) (string) {
+	return strings.TrimSuffix(fixture, FixtureExt) + GoldenExt
+}
+
+func checkFixture(fixture string, parse ParseFunc, update bool) (*GoldenResult) {
+	result := &GoldenResult{Fixture: fixture, Golden: GoldenPath(fixture)}
+
+	product, err := parse(fixture)
+	if IsNotProduct(err) {
+		product, err = nil, nil
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	actual := []byte("")
+	if product != nil {
+		if actual, err = MarshalProduct(product); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	if update {
+		result.Err = ioutil.WriteFile(result.Golden, actual, 0644)
+		result.Updated = result.Err == nil
+		return result
+	}
+
+	expected, err := ioutil.ReadFile(result.Golden)
+	if os.IsNotExist(err) {
+		result.Err = fmt.Errorf("%s: no golden file, run with -update", result.Golden)
+		return result
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if !bytes.Equal(expected, actual) {
+		result.Diff = LineDiff(string(expected), string(actual))
+	}
+	return result
+}
+
+// LineDiff возвращает построчную разницу в стиле unified diff без заголовков:
+// "-" строки из a, "+" строки из b, и по две строки контекста вокруг.
+func LineDiff(a string, b string) (string) {
+	al := strings.Split(a, "\n")
+	bl := strings.Split(b, "\n")
+
+	// lcs[i][j] - длина общей подпоследовательности al[i:] и bl[j:]
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	lines := make([]line, 0, len(al)+len(bl))
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			lines = append(lines, line{' ', al[i]})
+			i++
+			j++
+		case j < len(bl) && (i == len(al) || lcs[i][j+1] > lcs[i+1][j]):
+			lines = append(lines, line{'+', bl[j]})
+			j++
+		default:
+			lines = append(lines, line{'-', al[i]})
+			i++
+		}
+	}
+
+	const context = 2
+	show := make([]bool, len(lines))
+	changed := false
+	for k, l := range lines {
+		if l.op == ' ' {
+			continue
+		}
+		changed = true
+		for c := k - context; c <= k+context; c++ {
+			if c >= 0 && c < len(lines) {
+				show[c] = true
+			}
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for k, l := range lines {
+		if !show[k] {
+			if k > 0 && show[k-1] {
+				buf.WriteString("...\n")
+			}
+			continue
+		}
+		buf.WriteByte(l.op)
+		buf.WriteString(l.text)
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files from current parser output")
+
+// TestGolden сверяет разбор страниц из dir с эталонами, каждая фикстура -
+// отдельный подтест. go test -update перезаписывает эталоны.
+func TestGolden(t *testing.T, dir string, parse ParseFunc) {
+	results, err := CheckGolden(dir, parse, *updateGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatalf("no fixtures in %s", dir)
+	}
+	for _, r := range results {
+		r := r
+		t.Run(filepath.Base(r.Fixture), func(t *testing.T) {
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+			if r.Updated {
+				t.Logf("updated %s", r.Golden)
+			}
+			if r.Diff != "" {
+				t.Errorf("--- %s\n+++ parsed\n%s", r.Golden, r.Diff)
+			}
+		})
+	}
+}
+
+// CaptureFixture скачивает живую страницу в dir/name.html и сразу пишет
+// для нее эталон, чтобы его можно было проверить глазами и закоммитить.
+func CaptureFixture(ctx context.Context, url string, dir string, name string, charset string, parse ParseFunc) (*GoldenResult, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fixture := filepath.Join(dir, name+FixtureExt)
+	if err := DownloadPageContext(ctx, url, fixture, charset); err != nil {
+		return nil, err
+	}
+	return checkFixture(fixture, parse, true), nil
+}
@@ -0,0 +1,201 @@
+package libs
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Поля общего формата товара, для которых считается заполненность
+var ProductFields = []string{
+	"name", "shortName", "article", "collection", "price", "availability", "description", "attributes", "images",
+}
+
+func productField(p *Product, field string) (bool) {
+	switch field {
+	case "name":
+		return strings.TrimSpace(p.Name) != ""
+	case "shortName":
+		return strings.TrimSpace(p.ShortName) != ""
+	case "article":
+		return strings.TrimSpace(p.Article) != ""
+	case "collection":
+		return strings.TrimSpace(p.Collection) != ""
+	case "price":
+		return strings.TrimSpace(p.Price) != ""
+	case "availability":
+		return strings.TrimSpace(p.Availability) != ""
+	case "description":
+		return strings.TrimSpace(p.Description) != ""
+	case "attributes":
+		for _, a := range p.Attributes {
+			if strings.TrimSpace(a.Key) != "" && strings.TrimSpace(a.Value) != "" {
+				return true
+			}
+		}
+		return false
+	case "images":
+		return len(p.Images) > 0
+	}
+	return false
+}
+
+type FieldRate struct {
+	Field  string  `xml:"field,attr" json:"field"`
+	Filled int     `xml:"filled,attr" json:"filled"`
+	Rate   float64 `xml:"rate,attr" json:"rate"`
+}
+
+// FieldStats - доля товаров с заполненным полем за один прогон разбора.
+type FieldStats struct {
+	XMLName xml.Name     `xml:"fieldStats" json:"-"`
+	Site    string       `xml:"site" json:"site"`
+	Run     string       `xml:"run,omitempty" json:"run,omitempty"`
+	Time    time.Time    `xml:"time" json:"time"`
+	Total   int          `xml:"total" json:"total"`
+	Fields  []*FieldRate `xml:"fields>field" json:"fields"`
+}
+
+func NewFieldStats(site string, run string) (*FieldStats) {
+	stats := &FieldStats{Site: site, Run: run, Time: time.Now(), Fields: make([]*FieldRate, 0, len(ProductFields))}
+	for _, field := range ProductFields {
+		stats.Fields = append(stats.Fields, &FieldRate{Field: field})
+	}
+	return stats
+}
+
+func (s *FieldStats) Add(p *Product) {
+	s.Total++
+	for _, f := range s.Fields {
+		if productField(p, f.Field) {
+			f.Filled++
+		}
+		f.Rate = float64(f.Filled) / float64(s.Total)
+	}
+}
+
+func (s *FieldStats) Rate(field string) (float64, bool) {
+	for _, f := range s.Fields {
+		if f.Field == field {
+			return f.Rate, true
+		}
+	}
+	return 0, false
+}
+
+func SaveFieldStats(stats *FieldStats, filename string) (error) {
+	return saveXML(stats, filename)
+}
+
+// OpenFieldStats возвращает nil без ошибки, если прошлого прогона еще не было.
+func OpenFieldStats(filename string) (*FieldStats, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stats := new(FieldStats)
+	if err := xml.NewDecoder(f).Decode(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// HealthRules - пороги заполненности полей для одного сайта.
+type HealthRules struct {
+	// Поля, которые должны быть у каждого товара
+	Required []string
+	// Минимальная доля заполненных значений по полю
+	MinRate map[string]float64
+	// Допустимое падение доли относительно прошлого прогона
+	MaxDrop float64
+}
+
+// Check сравнивает прогон с порогами и с прошлым прогоном previous
+// (может быть nil) и возвращает список нарушений.
+func (rules *HealthRules) Check(current *FieldStats, previous *FieldStats) ([]string) {
+	problems := make([]string, 0)
+	if current.Total == 0 {
+		return append(problems, "no products parsed")
+	}
+
+	for _, field := range rules.Required {
+		rate, _ := current.Rate(field)
+		if rate < 1 {
+			problems = append(problems, fmt.Sprintf("required field %s is empty in %.0f%% of products", field, (1-rate)*100))
+		}
+	}
+
+	fields := make([]string, 0, len(rules.MinRate))
+	for field := range rules.MinRate {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		rate, _ := current.Rate(field)
+		if rate < rules.MinRate[field] {
+			problems = append(problems, fmt.Sprintf("field %s filled in %.0f%%, expected at least %.0f%%", field, rate*100, rules.MinRate[field]*100))
+		}
+	}
+
+	if previous != nil && rules.MaxDrop > 0 {
+		for _, p := range previous.Fields {
+			rate, ok := current.Rate(p.Field)
+			if ok && p.Rate-rate > rules.MaxDrop {
+				problems = append(problems, fmt.Sprintf("field %s dropped from %.0f%% to %.0f%% since %s", p.Field, p.Rate*100, rate*100, previous.Time.Format("2006-01-02 15:04")))
+			}
+		}
+	}
+	return problems
+}
+
+// CheckRun сверяет статистику прогона разбора с порогами и прошлым прогоном
+// из filename и громко пишет в лог о нарушениях. Статистика сохраняется
+// только для здорового прогона, как в RunCanary, чтобы следующий прогон
+// сравнивался со здоровым состоянием сайта, а не с поломкой.
+func CheckRun(ctx context.Context, rules *HealthRules, stats *FieldStats, filename string) ([]string) {
+	logger := L(ctx)
+	previous, err := OpenFieldStats(filename)
+	if err != nil {
+		logger.Warn("previous field stats not read", "file", filename, "error", err)
+	}
+	problems := rules.Check(stats, previous)
+	for _, problem := range problems {
+		logger.Error("SELECTOR DRIFT", "problem", problem)
+	}
+	if len(problems) > 0 {
+		logger.Warn("field stats not saved, run is unhealthy", "file", filename)
+		return problems
+	}
+	if err := SaveFieldStats(stats, filename); err != nil {
+		logger.Error("field stats not saved", "file", filename, "error", err)
+	}
+	return problems
+}
+
+func ReadLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
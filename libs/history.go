@@ -0,0 +1,322 @@
+package libs
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// История цен и наличия хранится в csv: каждый запуск дописывает строки
+// в конец, не переписывая файл, и тот же формат отдается аналитикам.
+var historyHeader = []string{"time", "key", "name", "url", "price", "value", "availability"}
+
+// Observation - цена и наличие товара в одном запуске.
+type Observation struct {
+	Time time.Time
+	// Ключ товара, см. stableKey: url:... или article:...
+	Key          string
+	Name         string
+	Url          string
+	Price        string
+	Availability string
+	// Цена числом, ok=false, если не разобралась
+	Value float64
+	Ok    bool
+}
+
+// HistoryStore - csv файл истории одного сайта.
+type HistoryStore struct {
+	Path string
+
+	m sync.Mutex
+}
+
+func OpenHistory(filename string) (*HistoryStore) {
+	return &HistoryStore{Path: filename}
+}
+
+// stableKey - ключ товара, который не меняется между запусками: адрес,
+// иначе артикул. Имя ключом не бывает, после переименования ряд товара
+// в истории разорвался бы на два.
+func stableKey(p *Product) (string) {
+	if url := strings.TrimSpace(p.Url); url != "" {
+		return "url:" + url
+	}
+	if article := strings.TrimSpace(p.Article); article != "" {
+		return "article:" + article
+	}
+	return ""
+}
+
+// Append дописывает наблюдения по товарам, снятым в момент t. Товары без
+// адреса и артикула пропускаются. Возвращает число записанных строк.
+func (h *HistoryStore) Append(t time.Time, products []*Product) (int, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	info, err := os.Stat(h.Path)
+	header := os.IsNotExist(err) || (err == nil && info.Size() == 0)
+	f, err := os.OpenFile(h.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	w := csv.NewWriter(f)
+	if header {
+		w.Write(historyHeader)
+	}
+	stamp := t.UTC().Format(time.RFC3339)
+	written := 0
+	for _, p := range products {
+		key := stableKey(p)
+		if key == "" {
+			continue
+		}
+		value := ""
+		if v, ok := ParsePrice(p.Price); ok {
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		w.Write([]string{stamp, key, p.Name, p.Url, p.Price, value, p.Availability})
+		written++
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return written, err
+	}
+	return written, f.Close()
+}
+
+// Read возвращает наблюдения с from до to включительно, нулевое время -
+// без границы. Нет файла - пустая история.
+func (h *HistoryStore) Read(from time.Time, to time.Time, match func(o *Observation) (bool)) ([]*Observation, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	observations := make([]*Observation, 0)
+	f, err := os.Open(h.Path)
+	if os.IsNotExist(err) {
+		return observations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = len(historyHeader)
+	line := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", h.Path, err)
+		}
+		if line == 1 && record[0] == historyHeader[0] {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, record[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", h.Path, line, err)
+		}
+		if (!from.IsZero() && t.Before(from)) || (!to.IsZero() && t.After(to)) {
+			continue
+		}
+		o := &Observation{Time: t, Key: record[1], Name: record[2], Url: record[3], Price: record[4], Availability: record[6]}
+		if record[5] != "" {
+			if o.Value, err = strconv.ParseFloat(record[5], 64); err == nil {
+				o.Ok = true
+			}
+		}
+		if match == nil || match(o) {
+			observations = append(observations, o)
+		}
+	}
+	return observations, nil
+}
+
+// MatchProduct подходит для Read: query - ключ целиком ("url:http://..."),
+// его значение (адрес, артикул) или имя товара.
+func MatchProduct(query string) (func(o *Observation) (bool)) {
+	return func(o *Observation) (bool) {
+		if o.Key == query {
+			return true
+		}
+		if o.Name == query {
+			return true
+		}
+		i := strings.Index(o.Key, ":")
+		return i >= 0 && o.Key[i+1:] == query
+	}
+}
+
+// Series - наблюдения одного товара по времени.
+func (h *HistoryStore) Series(query string, from time.Time, to time.Time) ([]*Observation, error) {
+	return h.Read(from, to, MatchProduct(query))
+}
+
+// PriceStats - цены товара за окно. First и Last - первая и последняя
+// разобранные цены, Delta - их разница.
+type PriceStats struct {
+	Key          string
+	Name         string
+	Url          string
+	Observations int
+	Priced       int
+	Min          float64
+	Max          float64
+	Avg          float64
+	First        float64
+	Last         float64
+	Delta        float64
+	Percent      float64
+	From         time.Time
+	To           time.Time
+	Availability string
+}
+
+// ProductStats сводит наблюдения по товарам, в порядке первого появления.
+func ProductStats(observations []*Observation) ([]*PriceStats) {
+	byKey := make(map[string]*PriceStats)
+	sum := make(map[string]float64)
+	stats := make([]*PriceStats, 0)
+	for _, o := range observations {
+		s := byKey[o.Key]
+		if s == nil {
+			s = &PriceStats{Key: o.Key, From: o.Time}
+			byKey[o.Key] = s
+			stats = append(stats, s)
+		}
+		s.Observations++
+		s.Name, s.Url, s.Availability = o.Name, o.Url, o.Availability
+		if o.Time.Before(s.From) {
+			s.From = o.Time
+		}
+		if o.Time.After(s.To) {
+			s.To = o.Time
+		}
+		if !o.Ok {
+			continue
+		}
+		if s.Priced == 0 {
+			s.Min, s.Max, s.First = o.Value, o.Value, o.Value
+		}
+		s.Priced++
+		s.Min = math.Min(s.Min, o.Value)
+		s.Max = math.Max(s.Max, o.Value)
+		s.Last = o.Value
+		sum[o.Key] += o.Value
+		s.Avg = sum[o.Key] / float64(s.Priced)
+		s.Delta = s.Last - s.First
+		if s.First != 0 {
+			s.Percent = math.Round(s.Delta/s.First*10000) / 100
+		}
+	}
+	return stats
+}
+
+// Stats - сводка по одному товару за окно, nil, если наблюдений нет.
+func (h *HistoryStore) Stats(query string, from time.Time, to time.Time) (*PriceStats, error) {
+	observations, err := h.Series(query, from, to)
+	if err != nil || len(observations) == 0 {
+		return nil, err
+	}
+	stats := ProductStats(observations)
+	if len(stats) > 1 {
+		return nil, fmt.Errorf("%q matches %d products, use the full key", query, len(stats))
+	}
+	return stats[0], nil
+}
+
+// Movers - товары, цена которых за окно изменилась сильнее всего по модулю
+// в процентах. limit <= 0 - все изменившиеся.
+func (h *HistoryStore) Movers(from time.Time, to time.Time, limit int) ([]*PriceStats, error) {
+	observations, err := h.Read(from, to, nil)
+	if err != nil {
+		return nil, err
+	}
+	movers := make([]*PriceStats, 0)
+	for _, s := range ProductStats(observations) {
+		if s.Priced > 1 && s.Delta != 0 {
+			movers = append(movers, s)
+		}
+	}
+	sort.SliceStable(movers, func(i, j int) (bool) {
+		return math.Abs(movers[i].Percent) > math.Abs(movers[j].Percent)
+	})
+	if limit > 0 && len(movers) > limit {
+		movers = movers[:limit]
+	}
+	return movers, nil
+}
+
+func formatFloat(v float64) (string) {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func WriteObservationsCSV(w io.Writer, observations []*Observation) (error) {
+	c := csv.NewWriter(w)
+	c.Write(historyHeader)
+	for _, o := range observations {
+		value := ""
+		if o.Ok {
+			value = formatFloat(o.Value)
+		}
+		c.Write([]string{o.Time.Format(time.RFC3339), o.Key, o.Name, o.Url, o.Price, value, o.Availability})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+func WriteStatsCSV(w io.Writer, stats []*PriceStats) (error) {
+	c := csv.NewWriter(w)
+	c.Write([]string{"key", "name", "url", "observations", "priced", "min", "max", "avg", "first", "last", "delta", "percent", "from", "to", "availability"})
+	for _, s := range stats {
+		c.Write([]string{
+			s.Key, s.Name, s.Url,
+			strconv.Itoa(s.Observations), strconv.Itoa(s.Priced),
+			formatFloat(s.Min), formatFloat(s.Max), formatFloat(math.Round(s.Avg*100) / 100),
+			formatFloat(s.First), formatFloat(s.Last), formatFloat(s.Delta), formatFloat(s.Percent),
+			s.From.Format(time.RFC3339), s.To.Format(time.RFC3339), s.Availability,
+		})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// RecordHistory дописывает в историю товары из filename, если файл
+// обновился после since: запуск отдельных стадий каталог не меняет, и
+// старые цены не должны попасть в историю второй раз.
+func RecordHistory(ctx context.Context, historyPath string, filename string, since time.Time, open func(filename string) ([]*Product, error)) (error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Before(since) {
+		L(ctx).Debug("history not recorded, catalog is not updated", "file", filename)
+		return nil
+	}
+	products, err := open(filename)
+	if err != nil {
+		return err
+	}
+	written, err := OpenHistory(historyPath).Append(info.ModTime(), products)
+	if err != nil {
+		return err
+	}
+	L(ctx).Info("history recorded", "file", historyPath, "observations", written)
+	if skipped := len(products) - written; skipped > 0 {
+		L(ctx).Warn("products without url or article are not recorded", "file", filename, "skipped", skipped)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package libs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStableKey(t *testing.T) {
+	cases := []struct {
+		product *Product
+		want    string
+	}{
+		{&Product{Url: "http://x/1", Article: "A1", Name: "Drill"}, "url:http://x/1"},
+		{&Product{Article: " A1 ", Name: "Drill"}, "article:A1"},
+		{&Product{Name: "Drill"}, ""},
+	}
+	for _, c := range cases {
+		if got := stableKey(c.product); got != c.want {
+			t.Errorf("stableKey(%+v) = %q, want %q", c.product, got, c.want)
+		}
+	}
+}
+
+func TestProductStats(t *testing.T) {
+	day := func(d int) (time.Time) {
+		return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC)
+	}
+	observation := func(d int, key string, value float64, ok bool) (*Observation) {
+		return &Observation{Time: day(d), Key: key, Name: key, Value: value, Ok: ok}
+	}
+	stats := ProductStats([]*Observation{
+		observation(1, "url:a", 100, true),
+		observation(1, "url:b", 0, false),
+		observation(2, "url:a", 80, true),
+		observation(2, "url:b", 50, true),
+		observation(3, "url:a", 120, true),
+		observation(3, "url:a", 0, false),
+	})
+	if len(stats) != 2 || stats[0].Key != "url:a" || stats[1].Key != "url:b" {
+		t.Fatalf("stats %+v, want url:a and url:b in order of appearance", stats)
+	}
+
+	cases := []struct {
+		got  *PriceStats
+		want PriceStats
+	}{
+		{stats[0], PriceStats{Key: "url:a", Name: "url:a", Observations: 4, Priced: 3, Min: 80, Max: 120, Avg: 100, First: 100, Last: 120, Delta: 20, Percent: 20, From: day(1), To: day(3)}},
+		{stats[1], PriceStats{Key: "url:b", Name: "url:b", Observations: 2, Priced: 1, Min: 50, Max: 50, Avg: 50, First: 50, Last: 50, From: day(1), To: day(2)}},
+	}
+	for _, c := range cases {
+		if *c.got != c.want {
+			t.Errorf("%s: %+v, want %+v", c.want.Key, *c.got, c.want)
+		}
+	}
+}
+
+func TestHistoryMovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h := OpenHistory(filepath.Join(dir, "history.csv"))
+
+	runs := []struct {
+		day      int
+		products []*Product
+	}{
+		{1, []*Product{
+			{Url: "http://x/drill", Name: "Drill", Price: "1 000 руб."},
+			{Url: "http://x/saw", Name: "Saw", Price: "500"},
+			{Article: "H1", Name: "Hammer", Price: "200"},
+			{Name: "No key", Price: "10"},
+		}},
+		{2, []*Product{
+			{Url: "http://x/drill", Name: "Drill", Price: "1 100 руб."},
+			{Url: "http://x/saw", Name: "Saw", Price: "250"},
+			{Article: "H1", Name: "Hammer", Price: "200"},
+		}},
+	}
+	for _, run := range runs {
+		written, err := h.Append(time.Date(2026, 10, run.day, 0, 0, 0, 0, time.UTC), run.products)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 3; written != want {
+			t.Errorf("day %d: %d rows written, want %d", run.day, written, want)
+		}
+	}
+
+	movers, err := h.Movers(time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		key     string
+		percent float64
+	}{
+		{"url:http://x/saw", -50},
+		{"url:http://x/drill", 10},
+	}
+	if len(movers) != len(want) {
+		t.Fatalf("%d movers, want %d", len(movers), len(want))
+	}
+	for i, w := range want {
+		if movers[i].Key != w.key || movers[i].Percent != w.percent {
+			t.Errorf("mover %d: %s %v%%, want %s %v%%", i, movers[i].Key, movers[i].Percent, w.key, w.percent)
+		}
+	}
+
+	limited, err := h.Movers(time.Time{}, time.Time{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limited) != 1 || limited[0].Key != "url:http://x/saw" {
+		t.Errorf("limit 1: %+v, want only the saw", limited)
+	}
+
+	stats, err := h.Stats("H1", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats == nil || stats.Observations != 2 || stats.Delta != 0 {
+		t.Errorf("hammer stats %+v, want 2 observations without change", stats)
+	}
+}
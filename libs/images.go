@@ -0,0 +1,281 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Картинки больше этого размера считаются ошибкой сайта
+const MaxImageSize = 32 << 20
+
+// ImageInfo описывает скачанную картинку. Встраивается в записи
+// каталогов граберов.
+type ImageInfo struct {
+	Format    string `xml:"format,omitempty" json:"format,omitempty"`
+	Width     int    `xml:"width,omitempty" json:"width,omitempty"`
+	Height    int    `xml:"height,omitempty" json:"height,omitempty"`
+	Size      int64  `xml:"size,omitempty" json:"size,omitempty"`
+	Hash      string `xml:"hash,omitempty" json:"hash,omitempty"`
+	Duplicate bool   `xml:"duplicate,omitempty" json:"duplicate,omitempty"`
+	// Перцептивные хэши, см. AHash и DHash
+	AHash       string `xml:"ahash,omitempty" json:"ahash,omitempty"`
+	DHash       string `xml:"dhash,omitempty" json:"dhash,omitempty"`
+	Placeholder bool   `xml:"placeholder,omitempty" json:"placeholder,omitempty"`
+}
+
+type NotImageError struct {
+	Url         string
+	ContentType string
+}
+
+func (e *NotImageError) Error() string {
+	return "not an image: " + e.Url + " (" + e.ContentType + ")"
+}
+
+var imageExt = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"webp": ".webp",
+	"bmp":  ".bmp",
+}
+
+// SniffImage определяет формат картинки по первым байтам.
+func SniffImage(b []byte) (string) {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg"
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(b, []byte("GIF87a")), bytes.HasPrefix(b, []byte("GIF89a")):
+		return "gif"
+	case len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(b, []byte("BM")):
+		return "bmp"
+	}
+	return ""
+}
+
+// ImageExt возвращает расширение файла для формата.
+func ImageExt(format string) (string) {
+	return imageExt[format]
+}
+
+// ImageStore складывает картинки в один каталог и не сохраняет повторно
+// картинку с тем же содержимым, даже если она пришла с другого товара.
+type ImageStore struct {
+	Dir string
+
+	m      sync.Mutex
+	hashes map[string]string
+}
+
+// NewImageStore индексирует уже скачанные картинки, чтобы повторный
+// запуск тоже не плодил копии. Картинки не раскодируются: индексу нужен
+// только хэш содержимого.
+func NewImageStore(dir string) (*ImageStore, error) {
+	store := &ImageStore{Dir: dir, hashes: make(map[string]string)}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		hash, ok, err := hashImageFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			store.hashes[hash] = file.Name()
+		}
+	}
+	return store, nil
+}
+
+// hashImageFile считает тот же sha1, что DescribeImage, потоком по файлу.
+// Файлы, которые не начинаются как картинка, пропускаются.
+func hashImageFile(filename string) (string, bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 16)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", false, err
+	}
+	if SniffImage(head[:n]) == "" {
+		return "", false, nil
+	}
+	h := sha1.New()
+	h.Write(head[:n])
+	if _, err := io.Copy(h, f); err != nil {
+		return "", false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), true, nil
+}
+
+// DescribeImage проверяет, что b - картинка, и считает ее размеры и хэш.
+func DescribeImage(b []byte) (*ImageInfo, error) {
+	info := &ImageInfo{Format: SniffImage(b), Size: int64(len(b))}
+	if info.Format == "" {
+		return nil, fmt.Errorf("unknown image format")
+	}
+
+	switch info.Format {
+	case "webp":
+		info.Width, info.Height = webpSize(b)
+	case "bmp":
+		if len(b) >= 26 {
+			info.Width = int(int32(binary.LittleEndian.Uint32(b[18:22])))
+			info.Height = int(int32(binary.LittleEndian.Uint32(b[22:26])))
+			if info.Height < 0 {
+				info.Height = -info.Height
+			}
+		}
+	default:
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		info.Width, info.Height = img.Bounds().Dx(), img.Bounds().Dy()
+		info.AHash = FormatHash(AHash(img))
+		info.DHash = FormatHash(DHash(img))
+	}
+
+	sum := sha1.Sum(b)
+	info.Hash = hex.EncodeToString(sum[:])
+	return info, nil
+}
+
+func webpSize(b []byte) (int, int) {
+	if len(b) < 30 {
+		return 0, 0
+	}
+	switch string(b[12:16]) {
+	case "VP8 ":
+		return int(binary.LittleEndian.Uint16(b[26:28]) & 0x3fff), int(binary.LittleEndian.Uint16(b[28:30]) & 0x3fff)
+	case "VP8L":
+		bits := binary.LittleEndian.Uint32(b[21:25])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1
+	case "VP8X":
+		w := int(b[24]) | int(b[25])<<8 | int(b[26])<<16
+		h := int(b[27]) | int(b[28])<<8 | int(b[29])<<16
+		return w + 1, h + 1
+	}
+	return 0, 0
+}
+
+// Download скачивает картинку и сохраняет ее как name + расширение по
+// настоящему формату, см. Save. Возвращает имя файла в каталоге хранилища;
+// если такая картинка уже есть, возвращается имя уже сохраненного файла.
+func (s *ImageStore) Download(url string, name string) (string, *ImageInfo, error) {
+	return s.DownloadContext(context.Background(), url, name)
+}
+
+func (s *ImageStore) DownloadContext(ctx context.Context, url string, name string) (string, *ImageInfo, error) {
+	res, cancel, err := Get(ctx, url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer cancel()
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", nil, &HTTPError{Url: url, Status: res.StatusCode}
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if !strings.HasPrefix(mediaType, "image/") && mediaType != "application/octet-stream" {
+			return "", nil, &NotImageError{Url: url, ContentType: contentType}
+		}
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, MaxImageSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(b) > MaxImageSize {
+		return "", nil, fmt.Errorf("%s: image is larger than %d bytes", url, MaxImageSize)
+	}
+
+	info, err := DescribeImage(b)
+	if err != nil {
+		return "", nil, &NotImageError{Url: url, ContentType: contentType}
+	}
+	return s.Save(b, info, name)
+}
+
+// Save сохраняет уже проверенную картинку с учетом дедупликации. Имена
+// из каталогов зависят от порядка товаров, поэтому занятое имя не
+// перезаписывается: картинка получает суффикс -2, -3 и так далее.
+func (s *ImageStore) Save(b []byte, info *ImageInfo, name string) (string, *ImageInfo, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if file, ok := s.hashes[info.Hash]; ok {
+		info.Duplicate = true
+		ImagesDeduplicated.Inc()
+		return file, info, nil
+	}
+
+	file, err := s.create(name, ImageExt(info.Format), b)
+	if err != nil {
+		return "", nil, err
+	}
+	s.hashes[info.Hash] = file
+	ImagesDownloaded.Inc()
+	return file, info, nil
+}
+
+// create пишет новый файл name+ext, а если он уже есть - name-2+ext и
+// дальше. O_EXCL не дает затереть файл, который успел записать другой
+// процесс с тем же каталогом.
+func (s *ImageStore) create(name string, ext string, b []byte) (string, error) {
+	for i := 1; ; i++ {
+		file := name + ext
+		if i > 1 {
+			file = fmt.Sprintf("%s-%d%s", name, i, ext)
+		}
+		f, err := os.OpenFile(filepath.Join(s.Dir, file), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(b)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(filepath.Join(s.Dir, file))
+			return "", err
+		}
+		return file, nil
+	}
+}
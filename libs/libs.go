@@ -1,42 +1,96 @@
 package libs
 
 import (
+	"context"
 	"net/http"
 	"time"
 	"os"
 	"io"
-	"log"
 	"github.com/djimenez/iconv-go"
 )
 
+// Таймаут одного запроса. Срок всего запуска задается контекстом.
+const RequestTimeout = 30 * time.Second
+
+var Client = &http.Client{Transport: &MetricsTransport{}}
+
+// Get выполняет GET с контекстом и таймаутом RequestTimeout, через сессию
+// сайта из контекста, если она есть. Тело ответа нужно дочитать до отмены cancel.
+func Get(ctx context.Context, url string) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if r := regionFrom(ctx); r != nil {
+		r.apply(req)
+	}
+	res, err := clientFor(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return res, cancel, nil
+}
+
 func DownloadAndSave(url string, file string, charset string) (error) {
+	return DownloadAndSaveContext(context.Background(), url, file, charset)
+}
+
+func DownloadAndSaveContext(ctx context.Context, url string, file string, charset string) (error) {
+	_, err := download(ctx, url, file, charset)
+	return err
+}
+
+// DownloadPage сохраняет страницу и рядом ее итоговый адрес, см. PageUrl.
+func DownloadPage(url string, file string, charset string) (error) {
+	return DownloadPageContext(context.Background(), url, file, charset)
+}
 
-	client := http.Client{Timeout: 30 * time.Second}
-	res, err := client.Get(url)
-	if res != nil {
-		defer res.Body.Close()
+func DownloadPageContext(ctx context.Context, url string, file string, charset string) (error) {
+	finalUrl, err := download(ctx, url, file, charset)
+	if err != nil {
+		return err
 	}
+	return savePageUrl(file, finalUrl)
+}
+
+func download(ctx context.Context, url string, file string, charset string) (string, error) {
+
+	started := time.Now()
+	res, cancel, err := Get(ctx, url)
 	if err != nil {
-		return err;
+		return "", err;
+	}
+	defer cancel()
+	defer res.Body.Close()
+	finalUrl := res.Request.URL.String()
+	if res.StatusCode >= 400 {
+		return "", &HTTPError{Url: url, Status: res.StatusCode}
 	}
 
 	f, err := os.Create(file)
 	if err != nil {
-		return err;
+		return "", err;
 	}
 	defer f.Close()
 
+	var body io.Reader = res.Body
 	if charset != "" {
-		utfBody, err := iconv.NewReader(res.Body, charset, "utf-8")
+		body, err = iconv.NewReader(res.Body, charset, "utf-8")
 		if err != nil {
-			return err
+			return "", err
 		}
-		io.Copy(f, utfBody)
-	} else {
-		io.Copy(f, res.Body)
 	}
+	// Ошибка чтения здесь - обычно отмена контекста посреди ответа
+	n, err := io.Copy(f, body)
+	if err != nil {
+		return "", err
+	}
+	L(ctx).Debug("fetched", "url", url, "file", file, "status", res.StatusCode, "bytes", n, "duration", time.Since(started))
 
-	return nil
+	return finalUrl, nil
 }
 
 func DownloadAndSaveChan(url string, file string, c chan string, e chan error, charset string) {
@@ -49,9 +103,8 @@ func DownloadAndSaveChan(url string, file string, c chan string, e chan error, c
 }
 
 func DownloadAndSaveSem(url string, file string, sem chan struct{}, charset string) {
-	if err := DownloadAndSave(url, file, charset); err != nil {
-		log.Println(err)
-		return
+	defer func() { <-sem }()
+	if err := DownloadPage(url, file, charset); err != nil {
+		Log.Warn("download failed", "file", file, "error", err)
 	}
-	<-sem
 }
@@ -0,0 +1,357 @@
+package libs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFormatEnv задает формат логов: json, logfmt или text (по умолчанию).
+const LogFormatEnv = "GRABIT_LOG"
+
+// LogLevelEnv задает уровень логов, общий и по сайтам: "info,compyou=debug".
+const LogLevelEnv = "GRABIT_LOG_LEVEL"
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() (string) {
+	if l < LevelDebug || l > LevelError {
+		return "level" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// LogLevels - уровень по умолчанию и уровни отдельных сайтов.
+type LogLevels struct {
+	Default Level
+	Sites   map[string]Level
+}
+
+// ParseLogLevels разбирает строку вида "warn,compyou=debug".
+func ParseLogLevels(s string) (*LogLevels, error) {
+	levels := &LogLevels{Default: LevelInfo, Sites: make(map[string]Level)}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		site, name := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			site, name = part[:i], part[i+1:]
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		if site == "" {
+			levels.Default = level
+		} else {
+			levels.Sites[site] = level
+		}
+	}
+	return levels, nil
+}
+
+func (l *LogLevels) Enabled(site string, level Level) (bool) {
+	if min, ok := l.Sites[site]; ok {
+		return level >= min
+	}
+	return level >= l.Default
+}
+
+// NewRunId возвращает идентификатор запуска: время старта и случайный хвост,
+// чтобы логи одного обхода можно было отобрать в общем хранилище.
+func NewRunId() (string) {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+type runKey struct{}
+
+// WithRun заводит в контексте запуск id: его записывают отчеты разбора
+// и статистика полей, а логгер контекста пишет поле run. Команды заводят
+// один запуск на процесс, serve - по запуску на каждую попытку.
+func WithRun(ctx context.Context, id string) (context.Context) {
+	ctx = context.WithValue(ctx, runKey{}, id)
+	return WithLogger(ctx, L(ctx).With("run", id))
+}
+
+// RunOf возвращает id запуска из контекста или пустую строку.
+func RunOf(ctx context.Context) (string) {
+	id, _ := ctx.Value(runKey{}).(string)
+	return id
+}
+
+type logSink struct {
+	m      sync.Mutex
+	out    io.Writer
+	format string
+	levels *LogLevels
+}
+
+// Logger пишет записи с уровнем и полями. With возвращает новый Logger
+// с добавленными полями, исходный не меняется.
+type Logger struct {
+	sink   *logSink
+	site   string
+	fields []interface{}
+}
+
+func NewLogger(out io.Writer, format string, levels *LogLevels) (*Logger) {
+	if levels == nil {
+		levels = &LogLevels{Default: LevelInfo}
+	}
+	return &Logger{sink: &logSink{out: out, format: format, levels: levels}}
+}
+
+// Log - логгер процесса, настраивается переменными LogFormatEnv и LogLevelEnv.
+var Log = envLogger()
+
+func envLogger() (*Logger) {
+	levels, err := ParseLogLevels(os.Getenv(LogLevelEnv))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		levels = &LogLevels{Default: LevelInfo}
+	}
+	return NewLogger(os.Stderr, os.Getenv(LogFormatEnv), levels)
+}
+
+func (l *Logger) With(kv ...interface{}) (*Logger) {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{sink: l.sink, site: l.site, fields: fields}
+}
+
+// Site добавляет поле site, по нему же выбирается уровень.
+func (l *Logger) Site(name string) (*Logger) {
+	child := l.With("site", name)
+	child.site = name
+	return child
+}
+
+func (l *Logger) Stage(name string) (*Logger) {
+	return l.With("stage", name)
+}
+
+func (l *Logger) Enabled(level Level) (bool) {
+	return l.sink.levels.Enabled(l.site, level)
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(LevelInfo, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(LevelWarn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Log пишет запись, kv - пары ключ, значение. Ошибка под ключом error
+// раскрывается: у PageError добавляются kind, file и url, у HTTPError - status.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	keys := []string{"time", "level", "msg"}
+	values := []interface{}{time.Now().UTC().Format(time.RFC3339Nano), level.String(), msg}
+	add := func(key string, value interface{}) {
+		for i, k := range keys {
+			if k == key {
+				values[i] = value
+				return
+			}
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if i+1 >= len(fields) {
+			add("!badkey", key)
+			break
+		}
+		value := fields[i+1]
+		if value == nil {
+			continue
+		}
+		switch v := value.(type) {
+		case error:
+			for _, f := range errorFields(v) {
+				add(f.key, f.value)
+			}
+			value = v.Error()
+		case time.Duration:
+			value = v.Seconds()
+			key += "Seconds"
+		case fmt.Stringer:
+			value = v.String()
+		}
+		add(key, value)
+	}
+
+	var line string
+	switch l.sink.format {
+	case "json":
+		line = formatJSON(keys, values)
+	case "logfmt":
+		line = formatLogfmt(keys, values)
+	default:
+		line = formatText(keys, values)
+	}
+
+	l.sink.m.Lock()
+	defer l.sink.m.Unlock()
+	io.WriteString(l.sink.out, line+"\n")
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+func errorFields(err error) ([]logField) {
+	fields := make([]logField, 0)
+	switch e := err.(type) {
+	case *PageError:
+		fields = append(fields, logField{"kind", string(e.Kind)})
+		if e.File != "" {
+			fields = append(fields, logField{"file", e.File})
+		}
+		if e.Url != "" {
+			fields = append(fields, logField{"url", e.Url})
+		}
+		if e.Field != "" {
+			fields = append(fields, logField{"field", e.Field})
+		}
+		if e.Err != nil {
+			fields = append(fields, errorFields(e.Err)...)
+		}
+	case *HTTPError:
+		fields = append(fields, logField{"url", e.Url}, logField{"status", e.Status})
+	}
+	return fields
+}
+
+func formatJSON(keys []string, values []interface{}) (string) {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(values[i])
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(values[i]))
+		}
+		b.Write(k)
+		b.WriteString(":")
+		b.Write(v)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func formatLogfmt(keys []string, values []interface{}) (string) {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + "=" + logfmtValue(values[i])
+	}
+	return strings.Join(parts, " ")
+}
+
+func logfmtValue(v interface{}) (string) {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatText - привычный вид для терминала: время, уровень, сообщение, поля.
+func formatText(keys []string, values []interface{}) (string) {
+	t, _ := time.Parse(time.RFC3339Nano, values[0].(string))
+	line := t.Local().Format("2006/01/02 15:04:05") + " " + strings.ToUpper(values[1].(string)) + " " + fmt.Sprint(values[2])
+	rest := make([]string, 0, len(keys))
+	for i := 3; i < len(keys); i++ {
+		if keys[i] == "run" {
+			continue
+		}
+		rest = append(rest, keys[i]+"="+logfmtValue(values[i]))
+	}
+	sort.Strings(rest)
+	if len(rest) > 0 {
+		line += " " + strings.Join(rest, " ")
+	}
+	return line
+}
+
+// Writer - io.Writer для стандартного log: каждая строка становится
+// записью уровня info, так что старые log.Println не теряются.
+func (l *Logger) Writer() (io.Writer) {
+	return logWriter{l}
+}
+
+type logWriter struct {
+	l *Logger
+}
+
+func (w logWriter) Write(b []byte) (int, error) {
+	w.l.Info(strings.TrimRight(string(b), "\n"))
+	return len(b), nil
+}
+
+type loggerKey struct{}
+
+// WithLogger кладет логгер в контекст, RunStages так передает стадиям
+// логгер с полями site и stage.
+func WithLogger(ctx context.Context, l *Logger) (context.Context) {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// L возвращает логгер из контекста или Log.
+func L(ctx context.Context) (*Logger) {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Log
+}
+
+// HTTPError - ответ сервера с кодом ошибки.
+type HTTPError struct {
+	Url    string
+	Status int
+}
+
+func (e *HTTPError) Error() (string) {
+	return e.Url + ": " + strconv.Itoa(e.Status) + " " + http.StatusText(e.Status)
+}
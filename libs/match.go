@@ -0,0 +1,417 @@
+package libs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MatchOptions задает пороги сопоставления товаров разных сайтов.
+type MatchOptions struct {
+	// Пары с уверенностью ниже Threshold не связываются
+	Threshold float64
+	// Слово из названия, которое есть у стольких товаров, не годится для
+	// поиска кандидатов: "компьютер", "дрель", "коврики"
+	MaxTokenProducts int
+}
+
+var DefaultMatchOptions = MatchOptions{Threshold: 0.6, MaxTokenProducts: 200}
+
+// Ключи характеристик без группы, в которых сайты пишут коды товара.
+// Характеристики в группе не годятся: у compyou "Процессор/Модель" -
+// модель процессора, а не компьютера.
+var (
+	eanKeys   = []string{"ean", "штрихкод", "штрих-код", "barcode"}
+	mpnKeys   = []string{"mpn", "артикул", "модель", "код производителя", "партномер"}
+	brandKeys = []string{"бренд", "производитель", "brand", "марка"}
+)
+
+// MatchReport - связи товаров разных сайтов для проверки человеком.
+type MatchReport struct {
+	XMLName   xml.Name        `xml:"matches"`
+	Time      time.Time       `xml:"time"`
+	Sites     []string        `xml:"sites>site"`
+	Threshold float64         `xml:"threshold"`
+	Matches   []*ProductMatch `xml:"match"`
+}
+
+// ProductMatch - один товар на нескольких сайтах, не больше одного
+// предложения с сайта. Confidence - самая слабая из связей группы.
+type ProductMatch struct {
+	Confidence float64          `xml:"confidence,attr"`
+	Products   []*LinkedProduct `xml:"product"`
+	Links      []*MatchLink     `xml:"link"`
+}
+
+type LinkedProduct struct {
+	Site    string `xml:"site,attr"`
+	Name    string `xml:"name"`
+	Url     string `xml:"url,omitempty"`
+	Article string `xml:"article,omitempty"`
+	Price   string `xml:"price,omitempty"`
+}
+
+// MatchLink - почему два товара связаны: совпал код (ean, mpn), модель
+// из названия или похожи название, бренд и характеристики.
+type MatchLink struct {
+	From       string   `xml:"from,attr"`
+	To         string   `xml:"to,attr"`
+	Method     string   `xml:"method,attr"`
+	Confidence float64  `xml:"confidence,attr"`
+	Reasons    []string `xml:"reason"`
+}
+
+// matchInfo - нормализованные признаки товара, считаются один раз.
+type matchInfo struct {
+	product *Product
+	tokens  map[string]bool
+	brand   string
+	ean     string
+	mpn     string
+	// mpn без бренда: "MAKITA6413" -> "6413", ищется среди слов названия
+	model string
+	specs map[string]string
+}
+
+// normalizeCode оставляет в коде только буквы и цифры в верхнем регистре.
+func normalizeCode(s string) (string) {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+// nameTokens - слова названия в нижнем регистре, "i5-8400" -> "i5", "8400", "i58400".
+func nameTokens(s string) (map[string]bool) {
+	tokens := make(map[string]bool)
+	for _, word := range strings.Fields(strings.ToLower(s)) {
+		parts := strings.FieldsFunc(word, func(r rune) (bool) {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, part := range parts {
+			if len([]rune(part)) > 1 || unicode.IsDigit([]rune(part)[0]) {
+				tokens[part] = true
+			}
+		}
+		if len(parts) > 1 {
+			tokens[strings.Join(parts, "")] = true
+		}
+	}
+	return tokens
+}
+
+func hasDigit(s string) (bool) {
+	return strings.IndexFunc(s, unicode.IsDigit) >= 0
+}
+
+func keyIn(key string, keys []string) (bool) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	for _, k := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+func newMatchInfo(p *Product) (*matchInfo) {
+	m := &matchInfo{product: p, tokens: nameTokens(p.Name), specs: make(map[string]string)}
+	for _, a := range p.Attributes {
+		value := strings.TrimSpace(a.Value)
+		if value == "" {
+			continue
+		}
+		m.specs[strings.ToLower(a.Group+"/"+strings.TrimSpace(a.Key))] = strings.ToLower(strings.Join(strings.Fields(value), " "))
+		if a.Group != "" {
+			continue
+		}
+		switch {
+		case keyIn(a.Key, eanKeys):
+			if code := normalizeCode(value); len(code) == 8 || len(code) == 13 {
+				m.ean = code
+			}
+		case keyIn(a.Key, mpnKeys) && m.mpn == "":
+			m.mpn = normalizeCode(value)
+		case keyIn(a.Key, brandKeys):
+			m.brand = strings.ToLower(value)
+		}
+	}
+
+	// Артикул autofanatik и ShortName vseinstrumenty ("Makita 6413") -
+	// коды производителя, если в характеристиках их нет
+	if m.mpn == "" && p.Article != "" {
+		m.mpn = normalizeCode(p.Article)
+	}
+	if short := strings.Fields(p.ShortName); len(short) > 1 {
+		if m.brand == "" {
+			m.brand = strings.ToLower(short[0])
+		}
+		if m.mpn == "" {
+			m.mpn = normalizeCode(p.ShortName)
+		}
+	}
+	m.model = m.mpn
+	if m.brand != "" {
+		m.model = strings.TrimPrefix(m.mpn, normalizeCode(m.brand))
+	}
+	// Слишком короткий код или код без цифр в названии найдется случайно
+	if len(m.model) < 3 || !hasDigit(m.model) {
+		m.model = ""
+	}
+	return m
+}
+
+// jaccard - доля общих слов двух названий.
+func jaccard(a map[string]bool, b map[string]bool) (float64) {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for token := range a {
+		if b[token] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// scorePair оценивает, один ли это товар. Коды дают почти полную
+// уверенность, иначе смешиваются сходство названий, бренд и характеристики.
+func scorePair(a *matchInfo, b *matchInfo) (*MatchLink) {
+	link := new(MatchLink)
+	brandsDiffer := a.brand != "" && b.brand != "" && a.brand != b.brand
+
+	switch {
+	case a.ean != "" && a.ean == b.ean:
+		link.Method, link.Confidence = "ean", 1
+		link.Reasons = append(link.Reasons, "ean "+a.ean)
+		return link
+	case a.mpn != "" && a.mpn == b.mpn && !brandsDiffer:
+		link.Method, link.Confidence = "mpn", 0.95
+		link.Reasons = append(link.Reasons, "mpn "+a.mpn)
+		return link
+	}
+
+	name := jaccard(a.tokens, b.tokens)
+	link.Method = "name"
+	link.Reasons = append(link.Reasons, fmt.Sprintf("name %.2f", name))
+
+	brand := 0.5
+	switch {
+	case brandsDiffer:
+		brand = 0
+		link.Reasons = append(link.Reasons, "brand "+a.brand+" != "+b.brand)
+	case a.brand != "" && a.brand == b.brand:
+		brand = 1
+		link.Reasons = append(link.Reasons, "brand "+a.brand)
+	case a.brand != "" && b.tokens[a.brand], b.brand != "" && a.tokens[b.brand]:
+		brand = 1
+		link.Reasons = append(link.Reasons, "brand in name")
+	}
+
+	shared, equal := 0, 0
+	for key, value := range a.specs {
+		if other, ok := b.specs[key]; ok {
+			shared++
+			if other == value {
+				equal++
+			}
+		}
+	}
+
+	score := 0.75*name + 0.25*brand
+	if shared > 0 {
+		score = 0.6*name + 0.2*brand + 0.2*float64(equal)/float64(shared)
+		link.Reasons = append(link.Reasons, fmt.Sprintf("specs %d/%d", equal, shared))
+	}
+
+	// Код модели одного товара среди слов названия другого
+	if brand > 0 && ((a.model != "" && b.tokens[strings.ToLower(a.model)]) || (b.model != "" && a.tokens[strings.ToLower(b.model)])) {
+		link.Method = "model"
+		link.Reasons = append(link.Reasons, "model in name")
+		score = math.Max(score, 0.85)
+	}
+	if brandsDiffer {
+		score /= 2
+	}
+	link.Confidence = math.Round(score*100) / 100
+	return link
+}
+
+// MatchProducts связывает товары разных сайтов. Кандидаты ищутся по
+// общим кодам и редким словам названия, пары принимаются от самых
+// уверенных, и в группу не попадает два товара одного сайта.
+func MatchProducts(products []*Product, opts MatchOptions) (*MatchReport) {
+	report := &MatchReport{Time: time.Now(), Threshold: opts.Threshold, Matches: make([]*ProductMatch, 0)}
+
+	infos := make([]*matchInfo, len(products))
+	sites := make(map[string]bool)
+	index := make(map[string][]int)
+	for i, p := range products {
+		infos[i] = newMatchInfo(p)
+		if !sites[p.Site] {
+			sites[p.Site] = true
+			report.Sites = append(report.Sites, p.Site)
+		}
+		for token := range infos[i].tokens {
+			index["token:"+token] = append(index["token:"+token], i)
+		}
+		for _, code := range []string{infos[i].ean, infos[i].mpn, strings.ToLower(infos[i].model)} {
+			if code != "" {
+				index["code:"+strings.ToLower(code)] = append(index["code:"+strings.ToLower(code)], i)
+			}
+		}
+	}
+	sort.Strings(report.Sites)
+
+	type pair struct {
+		a, b int
+		link *MatchLink
+	}
+	pairs := make([]*pair, 0)
+	for i, info := range infos {
+		candidates := make(map[int]bool)
+		add := func(key string) {
+			for _, j := range index[key] {
+				if j > i && infos[j].product.Site != info.product.Site {
+					candidates[j] = true
+				}
+			}
+		}
+		for token := range info.tokens {
+			if len(index["token:"+token]) <= opts.MaxTokenProducts {
+				add("token:" + token)
+			}
+			// Код модели другого товара может быть словом этого названия
+			add("code:" + token)
+		}
+		for _, code := range []string{info.ean, info.mpn, info.model} {
+			if code != "" {
+				add("code:" + strings.ToLower(code))
+			}
+		}
+		for j := range candidates {
+			if link := scorePair(info, infos[j]); link.Confidence >= opts.Threshold {
+				pairs = append(pairs, &pair{a: i, b: j, link: link})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) (bool) {
+		if pairs[i].link.Confidence != pairs[j].link.Confidence {
+			return pairs[i].link.Confidence > pairs[j].link.Confidence
+		}
+		if pairs[i].a != pairs[j].a {
+			return pairs[i].a < pairs[j].a
+		}
+		return pairs[i].b < pairs[j].b
+	})
+
+	parent := make([]int, len(products))
+	groupSites := make([]map[string]bool, len(products))
+	for i, p := range products {
+		parent[i] = i
+		groupSites[i] = map[string]bool{p.Site: true}
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	links := make(map[int][]*MatchLink)
+	for _, p := range pairs {
+		ra, rb := find(p.a), find(p.b)
+		if ra == rb {
+			continue
+		}
+		conflict := false
+		for site := range groupSites[rb] {
+			if groupSites[ra][site] {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			continue
+		}
+		parent[rb] = ra
+		for site := range groupSites[rb] {
+			groupSites[ra][site] = true
+		}
+		p.link.From = fmt.Sprintf("%s: %s", products[p.a].Site, products[p.a].Name)
+		p.link.To = fmt.Sprintf("%s: %s", products[p.b].Site, products[p.b].Name)
+		links[ra] = append(append(links[ra], links[rb]...), p.link)
+		delete(links, rb)
+	}
+
+	members := make(map[int][]int)
+	roots := make([]int, 0)
+	for i := range products {
+		root := find(i)
+		if _, ok := links[root]; !ok {
+			continue
+		}
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], i)
+	}
+	for _, root := range roots {
+		match := &ProductMatch{Confidence: 1, Links: links[root]}
+		for _, link := range match.Links {
+			match.Confidence = math.Min(match.Confidence, link.Confidence)
+		}
+		for _, i := range members[root] {
+			p := products[i]
+			match.Products = append(match.Products, &LinkedProduct{Site: p.Site, Name: p.Name, Url: p.Url, Article: p.Article, Price: p.Price})
+		}
+		sort.Slice(match.Products, func(i, j int) (bool) {
+			return match.Products[i].Site < match.Products[j].Site
+		})
+		report.Matches = append(report.Matches, match)
+	}
+	sort.SliceStable(report.Matches, func(i, j int) (bool) {
+		return report.Matches[i].Confidence > report.Matches[j].Confidence
+	})
+	return report
+}
+
+func SaveMatchReport(report *MatchReport, filename string) (error) {
+	return saveXML(report, filename)
+}
+
+// WriteSummary - по группе на строку с ценами на каждом сайте, чтобы
+// сразу видеть, где товар дешевле.
+func (r *MatchReport) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "%d match(es) across %s, threshold %.2f\n", len(r.Matches), strings.Join(r.Sites, ", "), r.Threshold)
+	for _, m := range r.Matches {
+		cheapest := -1
+		best := 0.0
+		for i, p := range m.Products {
+			if v, ok := ParsePrice(p.Price); ok && (cheapest < 0 || v < best) {
+				cheapest, best = i, v
+			}
+		}
+		fmt.Fprintf(w, "%.2f %s\n", m.Confidence, m.Products[0].Name)
+		for i, p := range m.Products {
+			mark := " "
+			if i == cheapest && len(m.Products) > 1 {
+				mark = "*"
+			}
+			price := p.Price
+			if price == "" {
+				price = "-"
+			}
+			fmt.Fprintf(w, "   %s %-16s %-14s %s\n", mark, p.Site, price, p.Name)
+		}
+	}
+}
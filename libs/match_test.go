@@ -0,0 +1,142 @@
+package libs
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNameTokens(t *testing.T) {
+	cases := []struct {
+		name string
+		want []string
+	}{
+		{"Компьютер Intel i5-8400", []string{"i5", "i58400", "intel", "компьютер", "8400"}},
+		{"Дрель Makita 6413 (в кейсе)", []string{"6413", "makita", "дрель", "кейсе"}},
+		{"Коврики 3 D", []string{"3", "коврики"}},
+	}
+	for _, c := range cases {
+		got := make([]string, 0)
+		for token := range nameTokens(c.name) {
+			got = append(got, token)
+		}
+		sort.Strings(got)
+		sort.Strings(c.want)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("nameTokens(%q) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMatchProducts(t *testing.T) {
+	product := func(site, name string, attributes ...string) (*Product) {
+		p := &Product{Site: site, Name: name}
+		for i := 0; i+1 < len(attributes); i += 2 {
+			p.AddAttribute("", attributes[i], attributes[i+1])
+		}
+		return p
+	}
+	cases := []struct {
+		name     string
+		products []*Product
+		// Группы как "site: name", по сайтам
+		want   [][]string
+		method string
+	}{
+		{
+			name: "ean",
+			products: []*Product{
+				product("a", "Перфоратор", "EAN", "4002395123456"),
+				product("b", "Перфоратор аккумуляторный черный", "Штрихкод", "4002395 123456"),
+			},
+			want:   [][]string{{"a: Перфоратор", "b: Перфоратор аккумуляторный черный"}},
+			method: "ean",
+		},
+		{
+			name: "mpn",
+			products: []*Product{
+				product("a", "Шуруповерт", "Артикул", "DF-333D"),
+				product("b", "Дрель-шуруповерт", "Модель", "df333d"),
+			},
+			want:   [][]string{{"a: Шуруповерт", "b: Дрель-шуруповерт"}},
+			method: "mpn",
+		},
+		{
+			name: "model in name",
+			products: []*Product{
+				product("a", "Дрель ударная", "Бренд", "Makita", "Артикул", "Makita 6413"),
+				product("b", "Дрель Makita 6413 в кейсе"),
+			},
+			want:   [][]string{{"a: Дрель ударная", "b: Дрель Makita 6413 в кейсе"}},
+			method: "model",
+		},
+		{
+			name: "name and brand",
+			products: []*Product{
+				product("a", "Дрель Makita 6413", "Бренд", "Makita"),
+				product("b", "Дрель Makita 6413", "Производитель", "makita"),
+			},
+			want:   [][]string{{"a: Дрель Makita 6413", "b: Дрель Makita 6413"}},
+			method: "name",
+		},
+		{
+			name: "brands differ",
+			products: []*Product{
+				product("a", "Дрель ударная 600 Вт", "Бренд", "Makita"),
+				product("b", "Дрель ударная 600 Вт", "Бренд", "Bosch"),
+			},
+			want: [][]string{},
+		},
+		{
+			name: "same site",
+			products: []*Product{
+				product("a", "Перфоратор", "EAN", "4002395123456"),
+				product("a", "Перфоратор", "EAN", "4002395123456"),
+			},
+			want: [][]string{},
+		},
+		{
+			name: "one offer per site",
+			products: []*Product{
+				product("a", "Перфоратор", "EAN", "4002395123456"),
+				product("b", "Перфоратор", "EAN", "4002395123456"),
+				product("b", "Перфоратор с патроном", "EAN", "4002395123456"),
+				product("c", "Перфоратор", "EAN", "4002395123456"),
+			},
+			want:   [][]string{{"a: Перфоратор", "b: Перфоратор", "c: Перфоратор"}},
+			method: "ean",
+		},
+		{
+			name: "unrelated",
+			products: []*Product{
+				product("a", "Коврики в салон"),
+				product("b", "Компьютер Intel i5-8400"),
+			},
+			want: [][]string{},
+		},
+	}
+	for _, c := range cases {
+		report := MatchProducts(c.products, DefaultMatchOptions)
+		got := make([][]string, 0)
+		for _, m := range report.Matches {
+			group := make([]string, 0)
+			for _, p := range m.Products {
+				group = append(group, p.Site+": "+p.Name)
+			}
+			got = append(got, group)
+			if len(m.Links) != len(m.Products)-1 {
+				t.Errorf("%s: %d links for %d products", c.name, len(m.Links), len(m.Products))
+			}
+			if m.Confidence < DefaultMatchOptions.Threshold {
+				t.Errorf("%s: confidence %v below threshold", c.name, m.Confidence)
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: matches %v, want %v", c.name, got, c.want)
+			continue
+		}
+		if c.method != "" && report.Matches[0].Links[0].Method != c.method {
+			t.Errorf("%s: method %s, want %s", c.name, report.Matches[0].Links[0].Method, c.method)
+		}
+	}
+}
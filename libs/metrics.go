@@ -0,0 +1,274 @@
+package libs
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsEnv - адрес, на котором отдавать /metrics, например ":9100".
+const MetricsEnv = "GRABIT_METRICS"
+
+// Registry хранит метрики и отдает их в текстовом формате Prometheus.
+type Registry struct {
+	m       sync.Mutex
+	metrics []*metricVec
+}
+
+func NewRegistry() (*Registry) {
+	return &Registry{}
+}
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	m      sync.Mutex
+	series map[string]*metricSeries
+}
+
+func (r *Registry) add(v *metricVec) (*metricVec) {
+	v.series = make(map[string]*metricSeries)
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.metrics = append(r.metrics, v)
+	if len(v.labels) == 0 {
+		// Метрика без меток видна с нулем еще до первого события
+		v.with(nil, func(s *metricSeries) {})
+	}
+	return v
+}
+
+// with вызывает f над рядом с метками values под блокировкой вектора.
+func (v *metricVec) with(values []string, f func(s *metricSeries)) {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: want %d labels, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.m.Lock()
+	defer v.m.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{labels: append([]string{}, values...)}
+		if v.kind == "histogram" {
+			s.buckets = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	f(s)
+}
+
+type CounterVec struct {
+	v *metricVec
+}
+
+func (r *Registry) NewCounter(name string, help string, labels ...string) (*CounterVec) {
+	return &CounterVec{r.add(&metricVec{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+func (c *CounterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *CounterVec) Add(delta float64, labels ...string) {
+	c.v.with(labels, func(s *metricSeries) { s.value += delta })
+}
+
+type GaugeVec struct {
+	v *metricVec
+}
+
+func (r *Registry) NewGauge(name string, help string, labels ...string) (*GaugeVec) {
+	return &GaugeVec{r.add(&metricVec{name: name, help: help, kind: "gauge", labels: labels})}
+}
+
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	g.v.with(labels, func(s *metricSeries) { s.value = value })
+}
+
+func (g *GaugeVec) Add(delta float64, labels ...string) {
+	g.v.with(labels, func(s *metricSeries) { s.value += delta })
+}
+
+// HistogramVec считает наблюдения по корзинам buckets (верхние границы).
+type HistogramVec struct {
+	v *metricVec
+}
+
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) (*HistogramVec) {
+	return &HistogramVec{r.add(&metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})}
+}
+
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	h.v.with(labels, func(s *metricSeries) {
+		s.value += value
+		s.count++
+		for i, le := range h.v.buckets {
+			if value <= le {
+				s.buckets[i]++
+			}
+		}
+	})
+}
+
+// WriteText пишет все метрики в текстовом формате Prometheus 0.0.4.
+func (r *Registry) WriteText(w io.Writer) (error) {
+	r.m.Lock()
+	metrics := append([]*metricVec{}, r.metrics...)
+	r.m.Unlock()
+
+	var b strings.Builder
+	for _, v := range metrics {
+		v.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (v *metricVec) write(b *strings.Builder) {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	b.WriteString("# HELP " + v.name + " " + escapeHelp(v.help) + "\n")
+	b.WriteString("# TYPE " + v.name + " " + v.kind + "\n")
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind != "histogram" {
+			b.WriteString(v.name + formatLabels(v.labels, s.labels, "", "") + " " + formatValue(s.value) + "\n")
+			continue
+		}
+		for i, le := range v.buckets {
+			b.WriteString(v.name + "_bucket" + formatLabels(v.labels, s.labels, "le", formatValue(le)) + " " + strconv.FormatUint(s.buckets[i], 10) + "\n")
+		}
+		b.WriteString(v.name + "_bucket" + formatLabels(v.labels, s.labels, "le", "+Inf") + " " + strconv.FormatUint(s.count, 10) + "\n")
+		b.WriteString(v.name + "_sum" + formatLabels(v.labels, s.labels, "", "") + " " + formatValue(s.value) + "\n")
+		b.WriteString(v.name + "_count" + formatLabels(v.labels, s.labels, "", "") + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) (string) {
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) (string) {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) (string) {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) (string) {
+	return helpEscaper.Replace(s)
+}
+
+// Handler отдает метрики по GET.
+func (r *Registry) Handler() (http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+// Metrics - метрики процесса.
+var Metrics = NewRegistry()
+
+var (
+	RequestsTotal      = Metrics.NewCounter("grabit_http_requests_total", "HTTP requests by host and status, status is \"error\" when no response came.", "host", "status")
+	DownloadedBytes    = Metrics.NewCounter("grabit_downloaded_bytes_total", "Response body bytes read.", "host")
+	FetchDuration      = Metrics.NewHistogram("grabit_fetch_duration_seconds", "Time until response headers.", DefaultBuckets, "host")
+	RetriesTotal       = Metrics.NewCounter("grabit_retries_total", "Urls queued again after a failed fetch.", "site")
+	ParseResults       = Metrics.NewCounter("grabit_parse_results_total", "Parsed pages by result: ok or error kind.", "site", "stage", "result")
+	ImagesDownloaded   = Metrics.NewCounter("grabit_images_downloaded_total", "Images saved to the image store.")
+	ImagesDeduplicated = Metrics.NewCounter("grabit_images_deduplicated_total", "Downloaded images that matched an already stored file.")
+	QueueDepth         = Metrics.NewGauge("grabit_queue_depth", "Items waiting in a crawl queue.", "site", "queue")
+	ProxyRequests      = Metrics.NewCounter("grabit_proxy_requests_total", "Requests through a proxy by result: ok, ban or error.", "proxy", "result")
+	ProxyUp            = Metrics.NewGauge("grabit_proxy_up", "1 if the proxy is in rotation.", "proxy")
+)
+
+// MetricsTransport считает запросы, задержку и байты ответов для всех
+// запросов через Client.
+type MetricsTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	host := req.URL.Host
+	started := time.Now()
+	res, err := base.RoundTrip(req)
+	FetchDuration.Observe(time.Since(started).Seconds(), host)
+	if err != nil {
+		RequestsTotal.Inc(host, "error")
+		return nil, err
+	}
+	RequestsTotal.Inc(host, strconv.Itoa(res.StatusCode))
+	res.Body = &countingBody{ReadCloser: res.Body, host: host}
+	return res, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	host string
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		DownloadedBytes.Add(float64(n), b.host)
+	}
+	return n, err
+}
+
+// ServeMetrics отдает /metrics на listen, пока работает процесс.
+func ServeMetrics(listen string) (error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Metrics.Handler())
+	return http.ListenAndServe(listen, mux)
+}
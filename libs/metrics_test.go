@@ -0,0 +1,169 @@
+package libs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readMetrics забирает /metrics и возвращает значения рядов по строке
+// `name{labels}`.
+func readMetrics(endpoint string) (map[string]float64, error) {
+	res, err := http.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", endpoint, res.Status)
+	}
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad metric line %q: %v", line, err)
+		}
+		values[line[:i]] = value
+	}
+	return values, scanner.Err()
+}
+
+func scrapeMetrics(t *testing.T, endpoint string) (map[string]float64) {
+	values, err := readMetrics(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// TestMetricsCrawl прогоняет маленький обход по тестовому сайту и
+// сверяет счетчики, которые отдает /metrics: посреди обхода и после него.
+func TestMetricsCrawl(t *testing.T) {
+	t.Setenv(ProgressEnv, "none")
+	// Вид прогресса запоминается при первом вызове, сбрасываем до и после
+	reporterOnce = sync.Once{}
+	t.Cleanup(func() { reporterOnce = sync.Once{} })
+
+	endpoint := httptest.NewServer(Metrics.Handler())
+	defer endpoint.Close()
+	// Счетчики общие на процесс, сверяем прирост за этот обход
+	before := scrapeMetrics(t, endpoint.URL+"/metrics")
+
+	// Пока отдается /saw, единственный загрузчик занят, и остальные адреса
+	// ждут в очереди: снимаем /metrics, пока глубина очереди не попадет в
+	// метрики (она снимается раз в секунду)
+	var mid map[string]float64
+	var midErr error
+	var site *httptest.Server
+	site = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			fmt.Fprint(w, "<urlset>")
+			for _, page := range []string{"/drill", "/saw", "/about", "/missing"} {
+				fmt.Fprintf(w, "<url><loc>%s%s</loc></url>", site.URL, page)
+			}
+			fmt.Fprint(w, "</urlset>")
+		case "/saw":
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+				mid, midErr = readMetrics(endpoint.URL + "/metrics")
+				if midErr != nil || mid[`grabit_queue_depth{site="metricstest",queue="urls"}`] > 0 {
+					break
+				}
+			}
+			fmt.Fprintf(w, "<html><h1>%s</h1></html>", r.URL.Path)
+		case "/drill", "/about":
+			fmt.Fprintf(w, "<html><h1>%s</h1></html>", r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+	host := strings.TrimPrefix(site.URL, "http://")
+
+	source := &StreamSource{
+		Site:       "metricstest",
+		SiteMapUrl: site.URL + "/sitemap.xml",
+		Parse: func(r io.Reader, pageUrl string, name string) (*Product, error) {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			u, err := url.Parse(pageUrl)
+			if err != nil {
+				return nil, err
+			}
+			if u.Path == "/about" {
+				return nil, NotProductError(name, pageUrl, "no product")
+			}
+			return &Product{Site: "metricstest", Name: string(b), Url: pageUrl}, nil
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := DefaultPipelineConfig
+	config.Fetchers, config.Parsers = 1, 2
+	err = RunStream(context.Background(), source, config, filepath.Join(dir, "products.xml"), filepath.Join(dir, "errors.xml"), &HealthRules{}, filepath.Join(dir, "stats.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if midErr != nil {
+		t.Fatal(midErr)
+	}
+	for _, series := range []string{
+		`grabit_http_requests_total{host="` + host + `",status="200"}`,
+		`grabit_downloaded_bytes_total{host="` + host + `"}`,
+		`grabit_fetch_duration_seconds_count{host="` + host + `"}`,
+		`grabit_queue_depth{site="metricstest",queue="urls"}`,
+	} {
+		if got := mid[series] - before[series]; got <= 0 {
+			t.Errorf("%s grew by %v during the crawl, want > 0", series, got)
+		}
+	}
+
+	values := scrapeMetrics(t, endpoint.URL+"/metrics")
+
+	expected := map[string]float64{
+		`grabit_http_requests_total{host="` + host + `",status="200"}`:                         4,
+		`grabit_http_requests_total{host="` + host + `",status="404"}`:                         1,
+		`grabit_parse_results_total{site="metricstest",stage="stream",result="ok"}`:            2,
+		`grabit_parse_results_total{site="metricstest",stage="stream",result="not-a-product"}`: 1,
+		`grabit_parse_results_total{site="metricstest",stage="stream",result="fetch"}`:         1,
+		`grabit_fetch_duration_seconds_count{host="` + host + `"}`:                             5,
+		`grabit_queue_depth{site="metricstest",queue="pages"}`:                                 0,
+	}
+	for series, want := range expected {
+		if _, ok := values[series]; !ok {
+			t.Errorf("%s is not exported", series)
+			continue
+		}
+		if got := values[series] - before[series]; got != want {
+			t.Errorf("%s = %v, want %v", series, got, want)
+		}
+	}
+	if got := values[`grabit_downloaded_bytes_total{host="`+host+`"}`] - before[`grabit_downloaded_bytes_total{host="`+host+`"}`]; got <= 0 {
+		t.Errorf("no downloaded bytes counted for %s", host)
+	}
+}
@@ -0,0 +1,282 @@
+package libs
+
+import (
+	"encoding/xml"
+	"image"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// AHash - средний хэш: картинка 8x8 в оттенках серого, бит равен 1,
+// если пиксель светлее среднего.
+func AHash(img image.Image) (uint64) {
+	g := grayscale(Resize(img, 8, 8))
+	var sum int
+	for _, v := range g {
+		sum += v
+	}
+	avg := sum / len(g)
+
+	var hash uint64
+	for i, v := range g {
+		if v > avg {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// DHash - разностный хэш: картинка 9x8, бит равен 1, если пиксель
+// светлее соседа справа. Устойчив к изменению яркости и размера.
+func DHash(img image.Image) (uint64) {
+	g := grayscale(Resize(img, 9, 8))
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if g[y*9+x] > g[y*9+x+1] {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+func grayscale(img *image.RGBA) ([]int) {
+	b := img.Bounds()
+	g := make([]int, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			g = append(g, (299*int(c.R)+587*int(c.G)+114*int(c.B))/1000)
+		}
+	}
+	return g
+}
+
+func FormatHash(hash uint64) (string) {
+	s := strconv.FormatUint(hash, 16)
+	for len(s) < 16 {
+		s = "0" + s
+	}
+	return s
+}
+
+func ParseHash(s string) (uint64, bool) {
+	hash, err := strconv.ParseUint(s, 16, 64)
+	return hash, err == nil && s != ""
+}
+
+func HammingDistance(a uint64, b uint64) (int) {
+	return bits.OnesCount64(a ^ b)
+}
+
+// ImageRef - картинка конкретного товара для анализа повторов.
+type ImageRef struct {
+	Product string
+	File    string
+	DHash   string
+	Info    *ImageInfo
+}
+
+type ImageCluster struct {
+	DHash    string   `xml:"dhash,attr"`
+	Products int      `xml:"products,attr"`
+	Files    []string `xml:"file"`
+}
+
+type Placeholders struct {
+	XMLName xml.Name `xml:"placeholders"`
+	Hashes  []string `xml:"dhash"`
+}
+
+// Contains ищет хэш в черном списке с допуском maxDistance бит.
+func (p *Placeholders) Contains(dhash string, maxDistance int) (bool) {
+	h, ok := ParseHash(dhash)
+	if !ok {
+		return false
+	}
+	for _, s := range p.Hashes {
+		if b, ok := ParseHash(s); ok && HammingDistance(h, b) <= maxDistance {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Placeholders) add(dhash string) {
+	if !p.Contains(dhash, 0) {
+		p.Hashes = append(p.Hashes, dhash)
+	}
+}
+
+func OpenPlaceholders(filename string) (*Placeholders, error) {
+	p := new(Placeholders)
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return p, xml.NewDecoder(f).Decode(p)
+}
+
+func SavePlaceholders(p *Placeholders, filename string) (error) {
+	sort.Strings(p.Hashes)
+	return saveXML(p, filename)
+}
+
+type PlaceholderProduct struct {
+	Product string   `xml:"product"`
+	Files   []string `xml:"file"`
+}
+
+// SharedImagesReport - результат поиска общих картинок за прогон.
+type SharedImagesReport struct {
+	XMLName          xml.Name              `xml:"sharedImages"`
+	Site             string                `xml:"site"`
+	Clusters         []*ImageCluster       `xml:"clusters>cluster"`
+	Placeholders     []string              `xml:"placeholders>dhash"`
+	OnlyPlaceholders []*PlaceholderProduct `xml:"onlyPlaceholders>item"`
+}
+
+// SharedImageOptions задает пороги поиска заглушек.
+type SharedImageOptions struct {
+	// Картинки с расстоянием dHash не больше MaxDistance считаются одинаковыми
+	MaxDistance int
+	// Картинка, которая есть у стольких разных товаров, считается заглушкой
+	MinProducts int
+}
+
+var DefaultSharedImageOptions = SharedImageOptions{MaxDistance: 4, MinProducts: 10}
+
+// FindSharedImages группирует почти одинаковые картинки, пополняет черный
+// список заглушек и помечает картинки-заглушки в ImageInfo.Placeholder.
+func FindSharedImages(site string, refs []*ImageRef, blacklist *Placeholders, opts SharedImageOptions) (*SharedImagesReport) {
+	report := &SharedImagesReport{Site: site}
+
+	hashes := make([]uint64, len(refs))
+	parent := make([]int, len(refs))
+	for i, ref := range refs {
+		parent[i] = i
+		hashes[i], _ = ParseHash(ref.DHash)
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	// Одинаковые хэши склеиваем сразу, дальше сравниваем только разные
+	first := make(map[uint64]int)
+	unique := make([]int, 0)
+	for i := range refs {
+		if refs[i].DHash == "" {
+			continue
+		}
+		if j, ok := first[hashes[i]]; ok {
+			parent[find(i)] = find(j)
+			continue
+		}
+		first[hashes[i]] = i
+		unique = append(unique, i)
+	}
+	// Хэши на расстоянии не больше MaxDistance при разбиении на
+	// MaxDistance+1 кусков совпадают хотя бы в одном куске целиком, так
+	// что сравниваются только хэши с общим куском, а не все пары
+	parts := opts.MaxDistance + 1
+	if parts < 1 {
+		parts = 1
+	}
+	if parts > 64 {
+		parts = 64
+	}
+	for part := 0; part < parts; part++ {
+		lo, hi := 64*part/parts, 64*(part+1)/parts
+		mask := (uint64(1)<<uint(hi-lo) - 1) << uint(lo)
+		buckets := make(map[uint64][]int)
+		for _, i := range unique {
+			key := hashes[i] & mask
+			for _, j := range buckets[key] {
+				if find(i) != find(j) && HammingDistance(hashes[i], hashes[j]) <= opts.MaxDistance {
+					parent[find(j)] = find(i)
+				}
+			}
+			buckets[key] = append(buckets[key], i)
+		}
+	}
+
+	groups := make(map[int][]*ImageRef)
+	for i, ref := range refs {
+		if ref.DHash != "" {
+			groups[find(i)] = append(groups[find(i)], ref)
+		}
+	}
+	for root, group := range groups {
+		products := make(map[string]bool)
+		files := make(map[string]bool)
+		cluster := &ImageCluster{DHash: refs[root].DHash}
+		for _, ref := range group {
+			products[ref.Product] = true
+			if !files[ref.File] {
+				files[ref.File] = true
+				cluster.Files = append(cluster.Files, ref.File)
+			}
+		}
+		cluster.Products = len(products)
+		if cluster.Products < 2 {
+			continue
+		}
+		sort.Strings(cluster.Files)
+		report.Clusters = append(report.Clusters, cluster)
+		if cluster.Products >= opts.MinProducts {
+			blacklist.add(cluster.DHash)
+		}
+	}
+	sort.Slice(report.Clusters, func(i, j int) bool {
+		return report.Clusters[i].Products > report.Clusters[j].Products
+	})
+
+	total := make(map[string]int)
+	placeholders := make(map[string][]string)
+	order := make([]string, 0)
+	for _, ref := range refs {
+		if _, ok := total[ref.Product]; !ok {
+			order = append(order, ref.Product)
+		}
+		total[ref.Product]++
+		if blacklist.Contains(ref.DHash, opts.MaxDistance) {
+			if ref.Info != nil {
+				ref.Info.Placeholder = true
+			}
+			placeholders[ref.Product] = append(placeholders[ref.Product], ref.File)
+		}
+	}
+	for _, product := range order {
+		if len(placeholders[product]) == total[product] {
+			report.OnlyPlaceholders = append(report.OnlyPlaceholders, &PlaceholderProduct{Product: product, Files: placeholders[product]})
+		}
+	}
+
+	report.Placeholders = blacklist.Hashes
+	return report
+}
+
+func SaveSharedImagesReport(report *SharedImagesReport, filename string) (error) {
+	return saveXML(report, filename)
+}
+
+func saveXML(v interface{}, filename string) (error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	e := xml.NewEncoder(f)
+	e.Indent("", "\t")
+	return e.Encode(v)
+}
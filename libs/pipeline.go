@@ -0,0 +1,392 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/djimenez/iconv-go"
+)
+
+// StreamSource описывает сайт для потокового режима.
+type StreamSource struct {
+	Site       string
+	SiteMapUrl string
+	// Какие адреса из карты сайта качать, nil - все
+	Filter  func(url string) (bool)
+	Charset string
+	Parse   ParseReaderFunc
+	// Как склеивать адреса одного товара, nil - DefaultCanonicalRules
+	Canonical *CanonicalRules
+}
+
+// PipelineConfig - размеры пулов и буферов потокового режима.
+type PipelineConfig struct {
+	Fetchers     int
+	Parsers      int
+	ImageWorkers int
+	// Размер каждой очереди между этапами
+	Buffer int
+	// Если задан, сырые страницы сохраняются сюда как pageN.html,
+	// чтобы их потом можно было разобрать обычным этапом parse
+	PagesDir string
+	// Если задан, картинки товаров скачиваются в это хранилище
+	Images *ImageStore
+}
+
+var DefaultPipelineConfig = PipelineConfig{Fetchers: 10, Parsers: 4, ImageWorkers: 10, Buffer: 100}
+
+type PipelineStats struct {
+	Discovered int64
+	Fetched    int64
+	Parsed     int64
+	Failed     int64
+	Images     int64
+	Written    int64
+}
+
+type fetchedPage struct {
+	index int
+	url   string
+	final string
+	body  []byte
+}
+
+// Pipeline качает, разбирает и сохраняет товары одновременно: адреса из
+// карты сайта идут через ограниченные очереди в загрузчики, парсеры,
+// загрузчики картинок и в Sink. Полная очередь притормаживает
+// предыдущий этап.
+type Pipeline struct {
+	Source *StreamSource
+	Config PipelineConfig
+	Sink   func(p *Product) (error)
+	Report   *ParseReport
+	Stats    *FieldStats
+	Progress *Progress
+
+	counters PipelineStats
+	m        sync.Mutex
+}
+
+func NewPipeline(source *StreamSource, config PipelineConfig, sink func(p *Product) (error)) (*Pipeline) {
+	return &Pipeline{
+		Source: source,
+		Config: config,
+		Sink:   sink,
+		Report: NewParseReport(source.Site, "stream", ""),
+		Stats:  NewFieldStats(source.Site, ""),
+	}
+}
+
+func (p *Pipeline) Counters() (PipelineStats) {
+	return PipelineStats{
+		Discovered: atomic.LoadInt64(&p.counters.Discovered),
+		Fetched:    atomic.LoadInt64(&p.counters.Fetched),
+		Parsed:     atomic.LoadInt64(&p.counters.Parsed),
+		Failed:     atomic.LoadInt64(&p.counters.Failed),
+		Images:     atomic.LoadInt64(&p.counters.Images),
+		Written:    atomic.LoadInt64(&p.counters.Written),
+	}
+}
+
+// Run работает, пока не кончится карта сайта, не будет отменен ctx
+// или Sink не вернет ошибку.
+func (p *Pipeline) Run(ctx context.Context) (error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var fatal error
+	var fatalOnce sync.Once
+	fail := func(err error) {
+		fatalOnce.Do(func() {
+			fatal = err
+			cancel()
+		})
+	}
+
+	buffer := p.Config.Buffer
+	urls := make(chan *fetchedPage, buffer)
+	pages := make(chan *fetchedPage, buffer)
+	parsed := make(chan *Product, buffer)
+	products := make(chan *Product, buffer)
+	ready := make(chan *Product, buffer)
+
+	// Страницы и дополнительные запросы делят общий лимит сайта, см. SiteLimit
+	fetchers := p.Config.Fetchers
+	if fetchers < 1 {
+		fetchers = 1
+	}
+	limit := SiteLimit(p.Source.Site, fetchers)
+	followUps := NewFollowUpFetcher(p.Source.Site, limit, p.Config.PagesDir)
+
+	// Глубину очередей снимаем раз в секунду, пока идет Run
+	depth := func() {
+		QueueDepth.Set(float64(len(urls)), p.Source.Site, "urls")
+		QueueDepth.Set(float64(len(pages)), p.Source.Site, "pages")
+		QueueDepth.Set(float64(len(parsed)), p.Source.Site, "parsed")
+		QueueDepth.Set(float64(len(products)), p.Source.Site, "products")
+		QueueDepth.Set(float64(len(ready)), p.Source.Site, "ready")
+	}
+	defer depth()
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				depth()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(urls)
+		seen := make(map[string]bool)
+		err := FetchSitemap(ctx, p.Source.SiteMapUrl, func(url string) (error) {
+			if p.Source.Filter != nil && !p.Source.Filter(url) {
+				return nil
+			}
+			url = p.Source.Canonical.Canonical(url)
+			if seen[url] {
+				return nil
+			}
+			seen[url] = true
+			page := &fetchedPage{index: len(seen) - 1, url: url}
+			atomic.AddInt64(&p.counters.Discovered, 1)
+			p.Progress.Add(1)
+			select {
+			case urls <- page:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			fail(err)
+		}
+	}()
+
+	stage(p.Config.Fetchers, func() {
+		for page := range urls {
+			err := acquire(ctx, limit)
+			if err == nil {
+				err = p.fetch(ctx, page)
+				release(limit)
+			}
+			if err != nil {
+				p.failed(ctx, page.url, FetchError(page.url, page.url, err))
+				continue
+			}
+			atomic.AddInt64(&p.counters.Fetched, 1)
+			p.Progress.AddBytes(int64(len(page.body)))
+			select {
+			case pages <- page:
+			case <-ctx.Done():
+			}
+		}
+	}, func() { close(pages) })
+
+	stage(p.Config.Parsers, func() {
+		for page := range pages {
+			product, err := p.Source.Parse(bytes.NewReader(page.body), page.final, page.url)
+			if IsNotProduct(err) {
+				p.m.Lock()
+				p.Report.NotProduct(page.url)
+				p.m.Unlock()
+				p.Progress.Done()
+				continue
+			}
+			if err != nil {
+				p.failed(ctx, page.url, err)
+				continue
+			}
+			canonicalProduct(p.Source, product, page.body, page.url)
+			atomic.AddInt64(&p.counters.Parsed, 1)
+			select {
+			case parsed <- product:
+			case <-ctx.Done():
+			}
+		}
+	}, func() { close(parsed) })
+
+	stage(p.Config.Fetchers, func() {
+		for product := range parsed {
+			followUps.Run(ctx, product)
+			select {
+			case products <- product:
+			case <-ctx.Done():
+			}
+		}
+	}, func() { close(products) })
+
+	stage(p.Config.ImageWorkers, func() {
+		for product := range products {
+			if p.Config.Images != nil {
+				p.downloadImages(ctx, product)
+			}
+			select {
+			case ready <- product:
+			case <-ctx.Done():
+			}
+		}
+	}, func() { close(ready) })
+
+	for product := range ready {
+		if ctx.Err() != nil {
+			continue
+		}
+		if err := p.Sink(product); err != nil {
+			p.Progress.Fail()
+			fail(err)
+			continue
+		}
+		atomic.AddInt64(&p.counters.Written, 1)
+		p.Progress.Done()
+		p.m.Lock()
+		p.Report.Ok()
+		p.Stats.Add(product)
+		p.m.Unlock()
+	}
+
+	if fatal != nil {
+		return fatal
+	}
+	return ctx.Err()
+}
+
+// stage запускает n воркеров и вызывает done, когда все они закончат.
+func stage(n int, worker func(), done func()) {
+	if n < 1 {
+		n = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		done()
+	}()
+}
+
+func (p *Pipeline) failed(ctx context.Context, name string, err error) {
+	L(ctx).Warn("page failed", "url", name, "error", err)
+	atomic.AddInt64(&p.counters.Failed, 1)
+	p.Progress.Fail()
+	p.m.Lock()
+	p.Report.Add(name, err)
+	p.m.Unlock()
+}
+
+// FetchPage скачивает страницу в память, перекодируя ее из charset в utf-8.
+// Возвращает итоговый адрес после редиректов и тело.
+func FetchPage(ctx context.Context, url string, charset string) (string, []byte, error) {
+	started := time.Now()
+	res, cancel, err := Get(ctx, url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer cancel()
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		return "", nil, &HTTPError{Url: url, Status: res.StatusCode}
+	}
+
+	var body io.Reader = res.Body
+	if charset != "" {
+		if body, err = iconv.NewReader(res.Body, charset, "utf-8"); err != nil {
+			return "", nil, err
+		}
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", nil, err
+	}
+	L(ctx).Debug("fetched", "url", url, "status", res.StatusCode, "bytes", len(b), "duration", time.Since(started))
+	return res.Request.URL.String(), b, nil
+}
+
+func (p *Pipeline) fetch(ctx context.Context, page *fetchedPage) (error) {
+	var err error
+	page.final, page.body, err = FetchPage(ctx, page.url, p.Source.Charset)
+	if err != nil {
+		return err
+	}
+
+	if p.Config.PagesDir != "" {
+		file := filepath.Join(p.Config.PagesDir, "page"+strconv.Itoa(page.index)+".html")
+		if err := ioutil.WriteFile(file, page.body, 0644); err != nil {
+			L(ctx).Warn("page not saved", "url", page.url, "file", file, "error", err)
+		} else if err := savePageUrl(file, page.final); err != nil {
+			L(ctx).Warn("page url not saved", "url", page.url, "file", file, "error", err)
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline) downloadImages(ctx context.Context, product *Product) {
+	for i, url := range product.Images {
+		atomic.AddInt64(&p.counters.Images, 1)
+		name := ProductImageName(product, i)
+		file, info, err := p.Config.Images.DownloadContext(ctx, url, name)
+		if err != nil {
+			L(ctx).Warn("image download failed", "url", url, "error", err)
+			continue
+		}
+		p.Progress.AddBytes(info.Size)
+		if product.ImageFiles == nil {
+			product.ImageFiles = new(ProductImages)
+		}
+		product.ImageFiles.Images = append(product.ImageFiles.Images, &ProductImage{Url: url, File: file, ImageInfo: *info})
+	}
+}
+
+// RunStream - потоковый режим целиком: товары пишутся в output по мере
+// разбора, в конце сохраняются отчет об ошибках и заполненность полей.
+func RunStream(ctx context.Context, source *StreamSource, config PipelineConfig, output string, errorsPath string, rules *HealthRules, statsPath string) (error) {
+	if config.PagesDir != "" {
+		if err := os.MkdirAll(config.PagesDir, 0755); err != nil {
+			return err
+		}
+	}
+	w, err := CreateProductWriter(output)
+	if err != nil {
+		return err
+	}
+
+	ctx = WithLogger(ctx, L(ctx).Site(source.Site).Stage("stream"))
+	pipeline := NewPipeline(source, config, w.Write)
+	pipeline.Report.Run, pipeline.Stats.Run = RunOf(ctx), RunOf(ctx)
+	pipeline.Progress = NewProgress(source.Site, "stream", 0)
+	runErr := pipeline.Run(ctx)
+	pipeline.Progress.Finish()
+	if err := w.Close(); err != nil && runErr == nil {
+		runErr = err
+	}
+
+	c := pipeline.Counters()
+	L(ctx).Info("stream finished", "discovered", c.Discovered, "fetched", c.Fetched, "parsed", c.Parsed, "failed", c.Failed, "written", c.Written)
+	if runErr == nil {
+		runErr = DedupeFile(ctx, output)
+	}
+
+	if err := pipeline.Report.Save(errorsPath); err != nil {
+		L(ctx).Error("parse report not saved", "file", errorsPath, "error", err)
+	}
+	if runErr == nil {
+		CheckRun(ctx, rules, pipeline.Stats, statsPath)
+	}
+	return runErr
+}
@@ -0,0 +1,149 @@
+package libs
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+type ImageJob struct {
+	Url string
+	// Имя файла без расширения, должно быть уникальным в рамках запуска
+	Name string
+}
+
+type ImageJobResult struct {
+	Job  *ImageJob
+	File string
+	Info *ImageInfo
+	Err  error
+}
+
+// ImagePool качает картинки в Store в Workers потоков, но не больше
+// PerHost одновременных запросов к одному хосту.
+type ImagePool struct {
+	Store    *ImageStore
+	Workers  int
+	PerHost  int
+	Progress *Progress
+
+	m     sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func NewImagePool(store *ImageStore, workers int, perHost int) (*ImagePool) {
+	return &ImagePool{Store: store, Workers: workers, PerHost: perHost, hosts: make(map[string]chan struct{})}
+}
+
+// ImageName строит имя файла из номера товара и номера картинки в нем,
+// так что имена не зависят от порядка скачивания и не пересекаются.
+func ImageName(prefix string, item int, image int) (string) {
+	return fmt.Sprintf("%s%06d-%02d", prefix, item, image)
+}
+
+// ProductImageName - имя картинки для потокового режима, где номера
+// товара нет: короткий хэш ключа товара (адрес, артикул или содержимое)
+// и номер картинки, так что имя не зависит от порядка разбора.
+func ProductImageName(p *Product, image int) (string) {
+	key := stableKey(p)
+	if key == "" {
+		key = ProductFingerprint(p)
+	}
+	sum := sha1.Sum([]byte(key))
+	return fmt.Sprintf("%s-%s-%02d", p.Site, hex.EncodeToString(sum[:6]), image)
+}
+
+func (p *ImagePool) hostSem(rawurl string) (chan struct{}) {
+	host := ""
+	if u, err := url.Parse(rawurl); err == nil {
+		host = u.Host
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.hosts == nil {
+		p.hosts = make(map[string]chan struct{})
+	}
+	sem, ok := p.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, p.PerHost)
+		p.hosts[host] = sem
+	}
+	return sem
+}
+
+func (p *ImagePool) Run(jobs []*ImageJob) ([]*ImageJobResult) {
+	return p.RunContext(context.Background(), jobs)
+}
+
+// RunContext скачивает все картинки и возвращает результаты в порядке jobs.
+// Результаты разбираются вызывающим уже после RunContext, поэтому каталог
+// не нужно защищать от одновременной записи. При отмене ctx новые
+// картинки не начинаются, а их результат содержит ctx.Err().
+func (p *ImagePool) RunContext(ctx context.Context, jobs []*ImageJob) ([]*ImageJobResult) {
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if p.PerHost < 1 {
+		p.PerHost = workers
+	}
+
+	results := make([]*ImageJobResult, len(jobs))
+	queue := make(chan int)
+	done := make(chan *ImageJobResult)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				job := jobs[i]
+				r := &ImageJobResult{Job: job}
+				sem := p.hostSem(job.Url)
+				select {
+				case sem <- struct{}{}:
+					r.File, r.Info, r.Err = p.Store.DownloadContext(ctx, job.Url, job.Name)
+					<-sem
+				case <-ctx.Done():
+					r.Err = ctx.Err()
+				}
+				results[i] = r
+				done <- r
+			}
+		}()
+	}
+
+	go func() {
+		defer close(done)
+		defer wg.Wait()
+		defer close(queue)
+		for i := range jobs {
+			select {
+			case queue <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for r := range done {
+		if r.Err != nil {
+			p.Progress.Fail()
+			continue
+		}
+		p.Progress.Done()
+		p.Progress.AddBytes(r.Info.Size)
+	}
+
+	for i, r := range results {
+		if r == nil {
+			results[i] = &ImageJobResult{Job: jobs[i], Err: ctx.Err()}
+		}
+	}
+	return results
+}
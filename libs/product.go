@@ -0,0 +1,198 @@
+package libs
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Product - общее представление товара, в которое каждый грабер
+// переводит свой CatalogItem. Используется для сравнения между сайтами.
+type Product struct {
+	XMLName      xml.Name            `xml:"product" json:"-"`
+	Site         string              `xml:"site" json:"site"`
+	Url          string              `xml:"url,omitempty" json:"url,omitempty"`
+	Aliases      []string            `xml:"alias,omitempty" json:"aliases,omitempty"`
+	Name         string              `xml:"name" json:"name"`
+	ShortName    string              `xml:"shortName,omitempty" json:"shortName,omitempty"`
+	Article      string              `xml:"article,omitempty" json:"article,omitempty"`
+	Collection   string              `xml:"collection,omitempty" json:"collection,omitempty"`
+	Price        string              `xml:"price,omitempty" json:"price,omitempty"`
+	Availability string              `xml:"availability,omitempty" json:"availability,omitempty"`
+	Description  string              `xml:"description,omitempty" json:"description,omitempty"`
+	Attributes   []*ProductAttribute `xml:"attributes>attribute" json:"attributes,omitempty"`
+	Images       []string            `xml:"images>image" json:"images,omitempty"`
+	// Скачанные картинки, заполняются только потоковым режимом
+	ImageFiles *ProductImages `xml:"imageFiles,omitempty" json:"imageFiles,omitempty"`
+	// Цены по регионам, заполняются проходом RunRegions
+	Regions *RegionOffers `xml:"regions,omitempty" json:"regions,omitempty"`
+	// Запросы за данными, которых нет в html, см. FollowUp
+	FollowUps []*FollowUp `xml:"-" json:"-"`
+}
+
+// ProductImages - обертка, чтобы пустой imageFiles не попадал в xml:
+// omitempty для пути a>b пустой родитель все равно пишет.
+type ProductImages struct {
+	Images []*ProductImage `xml:"image" json:"images"`
+}
+
+type ProductImage struct {
+	Url  string `xml:"url" json:"url"`
+	File string `xml:"file" json:"file"`
+	ImageInfo
+}
+
+type ProductAttribute struct {
+	Group string `xml:"group,omitempty" json:"group,omitempty"`
+	Key   string `xml:"key" json:"key"`
+	Value string `xml:"value" json:"value"`
+}
+
+func (p *Product) AddAttribute(group string, key string, value string) {
+	p.Attributes = append(p.Attributes, &ProductAttribute{Group: group, Key: key, Value: value})
+}
+
+func MarshalProduct(p *Product) ([]byte, error) {
+	b, err := xml.MarshalIndent(p, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func SaveProduct(p *Product, filename string) (error) {
+	b, err := MarshalProduct(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return err
+}
+
+// ProductWriter пишет товары в xml файл по одному, не держа весь
+// каталог в памяти. Файл становится корректным после Close.
+type ProductWriter struct {
+	m      sync.Mutex
+	f      *os.File
+	e      *xml.Encoder
+	closed bool
+}
+
+func CreateProductWriter(filename string) (*ProductWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(f, "<products>\n"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	e := xml.NewEncoder(f)
+	e.Indent("\t", "\t")
+	return &ProductWriter{f: f, e: e}, nil
+}
+
+func (w *ProductWriter) Write(p *Product) (error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if err := w.e.Encode(p); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.f, "\n")
+	return err
+}
+
+// Close можно звать повторно, например явно и еще раз в defer.
+func (w *ProductWriter) Close() (error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.e.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	if _, err := io.WriteString(w.f, "</products>\n"); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+type productsDocument struct {
+	XMLName  xml.Name   `xml:"products"`
+	Products []*Product `xml:"product"`
+}
+
+// OpenProducts читает файл, записанный ProductWriter.
+func OpenProducts(filename string) ([]*Product, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	doc := new(productsDocument)
+	if err := xml.NewDecoder(f).Decode(doc); err != nil {
+		return nil, err
+	}
+	return doc.Products, nil
+}
+
+// RecoverProducts читает товары из файла ProductWriter, который мог
+// остаться недописанным после падения: возвращаются все товары до
+// первого испорченного. Нет файла - нет и товаров.
+func RecoverProducts(filename string) ([]*Product, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	products := make([]*Product, 0)
+	d := xml.NewDecoder(f)
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return products, nil
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "product" {
+			continue
+		}
+		p := new(Product)
+		if err := d.DecodeElement(p, &start); err != nil {
+			return products, nil
+		}
+		products = append(products, p)
+	}
+}
+
+// LatestFile возвращает самый новый из существующих файлов.
+func LatestFile(filenames ...string) (string, error) {
+	latest := ""
+	var latestTime time.Time
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		if latest == "" || info.ModTime().After(latestTime) {
+			latest, latestTime = filename, info.ModTime()
+		}
+	}
+	if latest == "" {
+		return "", &os.PathError{Op: "open", Path: filenames[0], Err: os.ErrNotExist}
+	}
+	return latest, nil
+}
@@ -0,0 +1,348 @@
+package libs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestProfile - как сайт видит наши запросы: заголовки, куки и шаги
+// перед обходом. Читается из json в каталоге данных сайта.
+type RequestProfile struct {
+	UserAgent      string            `json:"userAgent,omitempty"`
+	AcceptLanguage string            `json:"acceptLanguage,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	// Файл, где куки хранятся между запусками. Пустой - куки живут до конца запуска
+	CookieFile string `json:"cookieFile,omitempty"`
+	// Запросы перед обходом: выбор региона, вход на сайт
+	Setup []*SetupStep `json:"setup,omitempty"`
+}
+
+// SetupStep - один подготовительный запрос. В значениях Form и Headers
+// подставляются переменные окружения: "${GRABIT_SHOP_PASSWORD}".
+type SetupStep struct {
+	// GET по умолчанию, POST, если есть Form
+	Method  string            `json:"method,omitempty"`
+	Url     string            `json:"url"`
+	Form    map[string]string `json:"form,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Шаг не нужен, если для Url уже есть такая кука, например сессия с прошлого запуска
+	SkipIfCookie string `json:"skipIfCookie,omitempty"`
+}
+
+// LoadProfile возвращает nil без ошибки, если профиля у сайта нет.
+func LoadProfile(filename string) (*RequestProfile, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	profile := new(RequestProfile)
+	if err := json.Unmarshal(b, profile); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return profile, nil
+}
+
+// CookieJar - cookiejar.Jar, который помнит выставленные куки, чтобы их
+// можно было сохранить в файл.
+type CookieJar struct {
+	jar *cookiejar.Jar
+
+	m     sync.Mutex
+	saved map[string]map[string]*savedCookie
+}
+
+type savedCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	HttpOnly bool       `json:"httpOnly,omitempty"`
+}
+
+type savedCookies struct {
+	Url     string         `json:"url"`
+	Cookies []*savedCookie `json:"cookies"`
+}
+
+func NewCookieJar() (*CookieJar) {
+	jar, _ := cookiejar.New(nil)
+	return &CookieJar{jar: jar, saved: make(map[string]map[string]*savedCookie)}
+}
+
+// OpenCookieJar читает куки, сохраненные Save. Нет файла - пустая банка.
+func OpenCookieJar(filename string) (*CookieJar, error) {
+	j := NewCookieJar()
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*savedCookies, 0)
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for _, entry := range entries {
+		u, err := url.Parse(entry.Url)
+		if err != nil {
+			continue
+		}
+		cookies := make([]*http.Cookie, 0, len(entry.Cookies))
+		for _, c := range entry.Cookies {
+			cookie := &http.Cookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, Secure: c.Secure, HttpOnly: c.HttpOnly}
+			if c.Expires != nil {
+				cookie.Expires = *c.Expires
+			}
+			cookies = append(cookies, cookie)
+		}
+		j.SetCookies(u, cookies)
+	}
+	return j, nil
+}
+
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	origin := u.Scheme + "://" + u.Host
+	now := time.Now()
+	j.m.Lock()
+	defer j.m.Unlock()
+	saved := j.saved[origin]
+	if saved == nil {
+		saved = make(map[string]*savedCookie)
+		j.saved[origin] = saved
+	}
+	for _, c := range cookies {
+		key := c.Name + "\xff" + c.Path + "\xff" + c.Domain
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(now)) {
+			delete(saved, key)
+			continue
+		}
+		cookie := &savedCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, Secure: c.Secure, HttpOnly: c.HttpOnly}
+		switch {
+		case c.MaxAge > 0:
+			expires := now.Add(time.Duration(c.MaxAge) * time.Second)
+			cookie.Expires = &expires
+		case !c.Expires.IsZero():
+			expires := c.Expires
+			cookie.Expires = &expires
+		}
+		saved[key] = cookie
+	}
+}
+
+func (j *CookieJar) Cookies(u *url.URL) ([]*http.Cookie) {
+	return j.jar.Cookies(u)
+}
+
+// Has сообщает, уйдет ли на rawUrl кука name.
+func (j *CookieJar) Has(rawUrl string, name string) (bool) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	for _, c := range j.jar.Cookies(u) {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *CookieJar) Save(filename string) (error) {
+	now := time.Now()
+	j.m.Lock()
+	entries := make([]*savedCookies, 0, len(j.saved))
+	for origin, saved := range j.saved {
+		entry := &savedCookies{Url: origin, Cookies: make([]*savedCookie, 0, len(saved))}
+		for _, c := range saved {
+			if c.Expires == nil || c.Expires.After(now) {
+				entry.Cookies = append(entry.Cookies, c)
+			}
+		}
+		if len(entry.Cookies) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	j.m.Unlock()
+
+	b, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0600)
+}
+
+// Session - клиент с профилем сайта. Кладется в контекст, и Get, а с ним
+// скачивание карты сайта, страниц и картинок, идет через него.
+type Session struct {
+	Site    string
+	Profile *RequestProfile
+	Client  *http.Client
+	Jar     *CookieJar
+}
+
+func NewSession(site string, profile *RequestProfile) (*Session, error) {
+	s := &Session{Site: site, Profile: profile, Jar: NewCookieJar()}
+	if profile.CookieFile != "" {
+		jar, err := OpenCookieJar(profile.CookieFile)
+		if err != nil {
+			return nil, err
+		}
+		s.Jar = jar
+	}
+	s.Client = &http.Client{Transport: &profileTransport{profile: profile}, Jar: s.Jar}
+	return s, nil
+}
+
+// profileTransport добавляет заголовки профиля к каждому запросу, включая
+// редиректы, и отдает его дальше в транспорт Client (метрики, прокси).
+type profileTransport struct {
+	profile *RequestProfile
+}
+
+func (t *profileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	setHeader := func(key string, value string) {
+		if value != "" && req.Header.Get(key) == "" {
+			req.Header.Set(key, value)
+		}
+	}
+	setHeader("User-Agent", t.profile.UserAgent)
+	setHeader("Accept-Language", t.profile.AcceptLanguage)
+	for key, value := range t.profile.Headers {
+		setHeader(key, value)
+	}
+
+	base := Client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// Setup выполняет подготовительные шаги профиля по порядку.
+func (s *Session) Setup(ctx context.Context) (error) {
+	for i, step := range s.Profile.Setup {
+		if step.SkipIfCookie != "" && s.Jar.Has(step.Url, step.SkipIfCookie) {
+			L(ctx).Debug("setup step skipped", "step", i+1, "url", step.Url, "cookie", step.SkipIfCookie)
+			continue
+		}
+		if err := s.setupStep(ctx, step); err != nil {
+			return fmt.Errorf("setup step %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *Session) setupStep(ctx context.Context, step *SetupStep) (error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+
+	method := step.Method
+	var body io.Reader
+	if len(step.Form) > 0 {
+		form := url.Values{}
+		for key, value := range step.Form {
+			form.Set(key, os.ExpandEnv(value))
+		}
+		body = strings.NewReader(form.Encode())
+		if method == "" {
+			method = "POST"
+		}
+	}
+	if method == "" {
+		method = "GET"
+	}
+
+	req, err := http.NewRequest(method, step.Url, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for key, value := range step.Headers {
+		req.Header.Set(key, os.ExpandEnv(value))
+	}
+	res, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode >= 400 {
+		return &HTTPError{Url: step.Url, Status: res.StatusCode}
+	}
+	L(ctx).Info("setup step done", "method", method, "url", step.Url, "status", res.StatusCode)
+	return nil
+}
+
+// Save сохраняет куки, если у профиля есть CookieFile.
+func (s *Session) Save() (error) {
+	if s.Profile.CookieFile == "" {
+		return nil
+	}
+	return s.Jar.Save(s.Profile.CookieFile)
+}
+
+type sessionKey struct{}
+
+func WithSession(ctx context.Context, s *Session) (context.Context) {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// SessionFrom возвращает сессию из контекста или nil.
+func SessionFrom(ctx context.Context) (*Session) {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// clientFor - клиент сессии из контекста или общий Client.
+func clientFor(ctx context.Context) (*http.Client) {
+	if s := SessionFrom(ctx); s != nil {
+		return s.Client
+	}
+	return Client
+}
+
+// StartSession читает профиль сайта из filename, выполняет его шаги и
+// возвращает контекст с сессией. done сохраняет куки, его зовут в конце
+// запуска. Без профиля контекст возвращается как есть.
+func StartSession(ctx context.Context, site string, filename string) (context.Context, func(), error) {
+	profile, err := LoadProfile(filename)
+	if err != nil || profile == nil {
+		return ctx, func() {}, err
+	}
+	session, err := NewSession(site, profile)
+	if err != nil {
+		return ctx, func() {}, err
+	}
+	logger := L(ctx).Site(site)
+	done := func() {
+		if err := session.Save(); err != nil {
+			logger.Error("cookies not saved", "file", profile.CookieFile, "error", err)
+		}
+	}
+	if err := session.Setup(WithLogger(ctx, logger)); err != nil {
+		done()
+		return ctx, func() {}, err
+	}
+	return WithSession(ctx, session), done, nil
+}
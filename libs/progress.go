@@ -0,0 +1,358 @@
+package libs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressEnv задает вид прогресса: bar, json, json:<файл> или none.
+// По умолчанию bar, если stderr - терминал, иначе none: под cron и serve
+// прогресс никто не смотрит. JSON пишется не в stderr к логам, а в свой
+// файл (json:/dev/fd/3 - в открытый дескриптор), просто json - в
+// DefaultProgressFile. Файл начинается заново при каждом запуске.
+const ProgressEnv = "GRABIT_PROGRESS"
+
+const DefaultProgressFile = "progress.jsonl"
+
+// ProgressSnapshot - состояние одной задачи на момент отчета.
+type ProgressSnapshot struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Site     string    `json:"site"`
+	Stage    string    `json:"stage"`
+	Total    int       `json:"total"`
+	Done     int       `json:"done"`
+	Failed   int       `json:"failed"`
+	Bytes    int64     `json:"bytes"`
+	Elapsed  float64   `json:"elapsedSeconds"`
+	Rate     float64   `json:"itemsPerSecond"`
+	ByteRate float64   `json:"bytesPerSecond"`
+}
+
+// ProgressReporter показывает прогресс задач. Report вызывается раз в
+// Interval, пока задача идет, Finish - один раз в конце.
+type ProgressReporter interface {
+	Interval() (time.Duration)
+	Report(s *ProgressSnapshot)
+	Finish(s *ProgressSnapshot)
+}
+
+var (
+	reporterOnce    sync.Once
+	defaultReporter ProgressReporter
+)
+
+// DefaultReporter выбирает вид прогресса по ProgressEnv и stderr, бар
+// рисуется в stderr.
+func DefaultReporter() (ProgressReporter) {
+	reporterOnce.Do(func() {
+		defaultReporter = NewReporter(os.Getenv(ProgressEnv), os.Stderr)
+	})
+	return defaultReporter
+}
+
+func NewReporter(mode string, out *os.File) (ProgressReporter) {
+	if mode == "" {
+		mode = "none"
+		if IsTerminal(out) {
+			mode = "bar"
+		}
+	}
+	switch {
+	case mode == "bar":
+		return &BarReporter{Out: out}
+	case mode == "none":
+		return NopReporter{}
+	case mode == "json", strings.HasPrefix(mode, "json:"):
+		filename := strings.TrimPrefix(strings.TrimPrefix(mode, "json"), ":")
+		if filename == "" {
+			filename = DefaultProgressFile
+		}
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			fmt.Fprintln(out, "progress:", err)
+			return NopReporter{}
+		}
+		return &JSONReporter{Out: f}
+	}
+	fmt.Fprintf(out, "progress: unknown %s=%q, use bar, json, json:<file> or none\n", ProgressEnv, mode)
+	return NopReporter{}
+}
+
+func IsTerminal(f *os.File) (bool) {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Progress считает обработанные элементы одной стадии. Методы можно
+// вызывать из нескольких горутин и на nil, тогда они ничего не делают.
+type Progress struct {
+	site     string
+	stage    string
+	reporter ProgressReporter
+	started  time.Time
+
+	m      sync.Mutex
+	total  int
+	done   int
+	failed int
+	bytes  int64
+
+	stop     chan struct{}
+	finished sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewProgress(site string, stage string, total int) (*Progress) {
+	return NewProgressReporter(site, stage, total, DefaultReporter())
+}
+
+// Идущие задачи, чтобы прогресс можно было спросить через api
+var (
+	activeM        sync.Mutex
+	activeProgress = make(map[*Progress]bool)
+)
+
+// ActiveProgress возвращает прогресс идущих задач сайта.
+func ActiveProgress(site string) ([]*ProgressSnapshot) {
+	activeM.Lock()
+	tasks := make([]*Progress, 0)
+	for p := range activeProgress {
+		if p.site == site {
+			tasks = append(tasks, p)
+		}
+	}
+	activeM.Unlock()
+
+	snapshots := make([]*ProgressSnapshot, 0, len(tasks))
+	for _, p := range tasks {
+		snapshots = append(snapshots, p.Snapshot("progress"))
+	}
+	sort.Slice(snapshots, func(i, j int) (bool) {
+		return snapshots[i].Elapsed > snapshots[j].Elapsed
+	})
+	return snapshots
+}
+
+func NewProgressReporter(site string, stage string, total int, reporter ProgressReporter) (*Progress) {
+	p := &Progress{site: site, stage: stage, total: total, reporter: reporter, started: time.Now(), stop: make(chan struct{})}
+	activeM.Lock()
+	activeProgress[p] = true
+	activeM.Unlock()
+	if interval := reporter.Interval(); interval > 0 {
+		p.wg.Add(1)
+		go p.loop(interval)
+	}
+	return p
+}
+
+func (p *Progress) loop(interval time.Duration) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.reporter.Report(p.Snapshot("progress"))
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Add увеличивает общее число элементов, когда оно заранее неизвестно.
+func (p *Progress) Add(n int) {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	p.total += n
+	p.m.Unlock()
+}
+
+func (p *Progress) Done() {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	p.done++
+	p.m.Unlock()
+}
+
+// Fail засчитывает элемент как обработанный с ошибкой.
+func (p *Progress) Fail() {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	p.done++
+	p.failed++
+	p.m.Unlock()
+}
+
+func (p *Progress) AddBytes(n int64) {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	p.bytes += n
+	p.m.Unlock()
+}
+
+// AddFile добавляет к скачанным байтам размер файла.
+func (p *Progress) AddFile(filename string) {
+	if p == nil {
+		return
+	}
+	if info, err := os.Stat(filename); err == nil {
+		p.AddBytes(info.Size())
+	}
+}
+
+func (p *Progress) Snapshot(event string) (*ProgressSnapshot) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	now := time.Now()
+	s := &ProgressSnapshot{
+		Event:   event,
+		Time:    now,
+		Site:    p.site,
+		Stage:   p.stage,
+		Total:   p.total,
+		Done:    p.done,
+		Failed:  p.failed,
+		Bytes:   p.bytes,
+		Elapsed: now.Sub(p.started).Seconds(),
+	}
+	if s.Elapsed > 0 {
+		s.Rate = float64(s.Done) / s.Elapsed
+		s.ByteRate = float64(s.Bytes) / s.Elapsed
+	}
+	return s
+}
+
+// Finish останавливает отчеты и выводит итог. Повторные вызовы ничего не делают.
+func (p *Progress) Finish() {
+	if p == nil {
+		return
+	}
+	p.finished.Do(func() {
+		activeM.Lock()
+		delete(activeProgress, p)
+		activeM.Unlock()
+		close(p.stop)
+		p.wg.Wait()
+		p.reporter.Finish(p.Snapshot("finished"))
+	})
+}
+
+// BarReporter рисует полосу прогресса в терминале, перезаписывая строку.
+type BarReporter struct {
+	Out   io.Writer
+	Width int
+
+	m sync.Mutex
+}
+
+func (r *BarReporter) Interval() (time.Duration) {
+	return 200 * time.Millisecond
+}
+
+func (r *BarReporter) Report(s *ProgressSnapshot) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	fmt.Fprint(r.Out, "\r"+r.line(s))
+}
+
+func (r *BarReporter) Finish(s *ProgressSnapshot) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	fmt.Fprintln(r.Out, "\r"+r.line(s))
+}
+
+func (r *BarReporter) line(s *ProgressSnapshot) (string) {
+	width := r.Width
+	if width <= 0 {
+		width = 40
+	}
+
+	line := s.Site + " " + s.Stage + " "
+	if s.Total > 0 {
+		filled := s.Done * width / s.Total
+		if filled > width {
+			filled = width
+		}
+		line += "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "] "
+		line += fmt.Sprintf("%d/%d", s.Done, s.Total)
+	} else {
+		line += fmt.Sprintf("%d", s.Done)
+	}
+	if s.Failed > 0 {
+		line += fmt.Sprintf(" failed %d", s.Failed)
+	}
+	line += fmt.Sprintf(" %.1f/s", s.Rate)
+	if s.Bytes > 0 {
+		line += " " + FormatBytes(int64(s.ByteRate)) + "/s"
+	}
+	// Хвост затирает остатки более длинной предыдущей строки
+	return line + "    "
+}
+
+// JSONReporter пишет по строке JSON на событие, чтобы прогресс можно было
+// читать планировщиком без разбора логов.
+type JSONReporter struct {
+	Out   io.Writer
+	Every time.Duration
+
+	m sync.Mutex
+}
+
+func (r *JSONReporter) Interval() (time.Duration) {
+	if r.Every > 0 {
+		return r.Every
+	}
+	return 5 * time.Second
+}
+
+func (r *JSONReporter) Report(s *ProgressSnapshot) {
+	r.write(s)
+}
+
+func (r *JSONReporter) Finish(s *ProgressSnapshot) {
+	r.write(s)
+}
+
+func (r *JSONReporter) write(s *ProgressSnapshot) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.Out.Write(append(b, '\n'))
+}
+
+type NopReporter struct{}
+
+func (NopReporter) Interval() (time.Duration) { return 0 }
+func (NopReporter) Report(s *ProgressSnapshot) {}
+func (NopReporter) Finish(s *ProgressSnapshot) {}
+
+func FormatBytes(n int64) (string) {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
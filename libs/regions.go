@@ -0,0 +1,225 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Region - регион магазина. Сайт выбирает его по куке или по поддомену.
+type Region struct {
+	Name string `json:"name"`
+	// Хост региона вместо хоста из адреса товара: "spb.vseinstrumenti.ru"
+	Host    string            `json:"host,omitempty"`
+	Cookies map[string]string `json:"cookies,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// LoadRegions возвращает nil без ошибки, если регионы для сайта не заданы.
+func LoadRegions(filename string) ([]*Region, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	regions := make([]*Region, 0)
+	if err := json.Unmarshal(b, &regions); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for i, r := range regions {
+		if r.Name == "" {
+			return nil, fmt.Errorf("%s: region #%d has no name", filename, i+1)
+		}
+	}
+	return regions, nil
+}
+
+// Url - адрес товара в регионе.
+func (r *Region) Url(rawUrl string) (string) {
+	if r.Host == "" {
+		return rawUrl
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	u.Host = r.Host
+	return u.String()
+}
+
+// apply добавляет к запросу куки и заголовки региона. Они уходят раньше
+// кук сессии, так что выбранный регион перекрывает сохраненный.
+func (r *Region) apply(req *http.Request) {
+	for name, value := range r.Cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	for key, value := range r.Headers {
+		req.Header.Set(key, value)
+	}
+}
+
+type regionKey struct{}
+
+// WithRegion - запросы Get с этим контекстом идут от имени региона.
+func WithRegion(ctx context.Context, r *Region) (context.Context) {
+	return context.WithValue(ctx, regionKey{}, r)
+}
+
+func regionFrom(ctx context.Context) (*Region) {
+	r, _ := ctx.Value(regionKey{}).(*Region)
+	return r
+}
+
+// RegionOffers - обертка, чтобы товар без регионов не писал пустой regions.
+type RegionOffers struct {
+	Offers []*RegionOffer `xml:"offer" json:"offers"`
+}
+
+// RegionOffer - цена и наличие товара в одном регионе.
+type RegionOffer struct {
+	Region       string `xml:"region,attr" json:"region"`
+	Url          string `xml:"url" json:"url"`
+	Price        string `xml:"price,omitempty" json:"price,omitempty"`
+	Availability string `xml:"availability,omitempty" json:"availability,omitempty"`
+	Error        string `xml:"error,omitempty" json:"error,omitempty"`
+}
+
+// CaptureRegions заново качает каждый товар с адресом во всех регионах
+// и записывает в товар цену и наличие по регионам. Ошибка страницы
+// попадает в Error предложения и не останавливает проход.
+func CaptureRegions(ctx context.Context, source *StreamSource, regions []*Region, products []*Product, parallel int) (error) {
+	type task struct {
+		offer  *RegionOffer
+		region *Region
+	}
+	tasks := make([]*task, 0, len(products)*len(regions))
+	withUrl := 0
+	for _, p := range products {
+		if p.Url == "" {
+			continue
+		}
+		withUrl++
+		p.Regions = &RegionOffers{Offers: make([]*RegionOffer, 0, len(regions))}
+		for _, r := range regions {
+			offer := &RegionOffer{Region: r.Name, Url: r.Url(p.Url)}
+			p.Regions.Offers = append(p.Regions.Offers, offer)
+			tasks = append(tasks, &task{offer: offer, region: r})
+		}
+	}
+	if len(tasks) == 0 && len(products) > 0 {
+		return errors.New("no product urls, regions need products from the stream mode")
+	}
+
+	progress := NewProgress(source.Site, "regions", len(tasks))
+	defer progress.Finish()
+	report := NewParseReport(source.Site, "regions", RunOf(ctx))
+	// Ответы дополнительных запросов зависят от региона, поэтому кеш у
+	// каждого региона свой, а лимит запросов - общий для сайта
+	limit := SiteLimit(source.Site, parallel)
+	followUps := make(map[*Region]*FollowUpFetcher, len(regions))
+	for _, r := range regions {
+		followUps[r] = NewFollowUpFetcher(source.Site, limit, "")
+	}
+
+	queue := make(chan *task)
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				err := captureOffer(WithRegion(ctx, t.region), source, t.offer, limit, followUps[t.region])
+				m.Lock()
+				if err != nil {
+					t.offer.Error = err.Error()
+					report.Add(t.offer.Url, err)
+					progress.Fail()
+				} else {
+					report.Ok()
+					progress.Done()
+				}
+				m.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, t := range tasks {
+		select {
+		case queue <- t:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	L(ctx).Info("regions captured", "products", withUrl, "regions", len(regions), "offers", report.Parsed, "failed", len(report.Errors))
+	return ctx.Err()
+}
+
+func captureOffer(ctx context.Context, source *StreamSource, offer *RegionOffer, limit chan struct{}, followUps *FollowUpFetcher) (error) {
+	if err := acquire(ctx, limit); err != nil {
+		return FetchError(offer.Url, offer.Url, err)
+	}
+	final, body, err := FetchPage(ctx, offer.Url, source.Charset)
+	release(limit)
+	if err != nil {
+		return FetchError(offer.Url, offer.Url, err)
+	}
+	product, err := source.Parse(bytes.NewReader(body), final, offer.Url)
+	if err != nil {
+		return err
+	}
+	// Наличие часто приходит отдельным запросом, и тоже зависит от региона
+	followUps.Run(ctx, product)
+	offer.Price = product.Price
+	offer.Availability = product.Availability
+	return nil
+}
+
+// RunRegions - проход по регионам для товаров из filename: товары
+// перезаписываются вместе с ценами по регионам из regionsPath.
+func RunRegions(ctx context.Context, source *StreamSource, regionsPath string, filename string) (error) {
+	regions, err := LoadRegions(regionsPath)
+	if err != nil {
+		return err
+	}
+	if len(regions) == 0 {
+		return errors.New("no regions in " + regionsPath)
+	}
+	products, err := OpenProducts(filename)
+	if err != nil {
+		return err
+	}
+
+	ctx = WithLogger(ctx, L(ctx).Site(source.Site).Stage("regions"))
+	if err := CaptureRegions(ctx, source, regions, products, DefaultPipelineConfig.Fetchers); err != nil {
+		return err
+	}
+
+	// Пишем рядом и подменяем, чтобы оборванный проход не испортил товары
+	w, err := CreateProductWriter(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	for _, p := range products {
+		if err := w.Write(p); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
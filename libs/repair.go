@@ -0,0 +1,195 @@
+package libs
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RepairHints - данные товара, по которым стратегии угадывают адрес картинки.
+type RepairHints struct {
+	Article string
+}
+
+type RepairCandidate struct {
+	Url        string
+	Strategy   string
+	Confidence float64
+}
+
+// RepairStrategy предлагает возможные правильные адреса для битой ссылки.
+type RepairStrategy interface {
+	Name() string
+	Candidates(source string, hints *RepairHints) []*RepairCandidate
+}
+
+type RepairResult struct {
+	Url        string
+	Strategy   string
+	Confidence float64
+	Tried      int
+}
+
+// Repairer перебирает кандидатов всех стратегий по убыванию уверенности
+// и возвращает первого, который реально существует на сервере.
+type Repairer struct {
+	Strategies []RepairStrategy
+	Probe      func(ctx context.Context, url string) (bool)
+
+	m      sync.Mutex
+	probed map[string]bool
+}
+
+func NewRepairer(strategies ...RepairStrategy) (*Repairer) {
+	return &Repairer{Strategies: strategies, Probe: ProbeUrl, probed: make(map[string]bool)}
+}
+
+func (r *Repairer) exists(ctx context.Context, url string) (bool) {
+	r.m.Lock()
+	ok, done := r.probed[url]
+	r.m.Unlock()
+	if done {
+		return ok
+	}
+	ok = r.Probe(ctx, url)
+	if ctx.Err() != nil {
+		// Отмененная проверка ничего не говорит о ссылке
+		return false
+	}
+	r.m.Lock()
+	r.probed[url] = ok
+	r.m.Unlock()
+	return ok
+}
+
+// Repair возвращает nil, если ни один кандидат не нашелся на сервере.
+func (r *Repairer) Repair(ctx context.Context, source string, hints *RepairHints) (*RepairResult) {
+	candidates := make([]*RepairCandidate, 0)
+	seen := make(map[string]bool)
+	for _, strategy := range r.Strategies {
+		for _, c := range strategy.Candidates(source, hints) {
+			if c.Url == "" || seen[c.Url] {
+				continue
+			}
+			seen[c.Url] = true
+			if c.Strategy == "" {
+				c.Strategy = strategy.Name()
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+
+	for i, c := range candidates {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if r.exists(ctx, c.Url) {
+			return &RepairResult{Url: c.Url, Strategy: c.Strategy, Confidence: c.Confidence, Tried: i + 1}
+		}
+	}
+	return nil
+}
+
+// ProbeUrl проверяет, что по адресу отдается картинка. Сначала HEAD,
+// а если сервер его не поддерживает - GET первого байта.
+func ProbeUrl(ctx context.Context, url string) (bool) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return false
+	}
+	res, err := clientFor(ctx).Do(req.WithContext(ctx))
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode != http.StatusMethodNotAllowed && res.StatusCode != http.StatusNotImplemented {
+			return probeOk(res)
+		}
+	}
+
+	req, err = http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	res, err = clientFor(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return probeOk(res)
+}
+
+func probeOk(res *http.Response) (bool) {
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	contentType := res.Header.Get("Content-Type")
+	return contentType == "" || strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "application/octet-stream")
+}
+
+// AsIs - исходная ссылка без изменений.
+type AsIs struct{}
+
+func (AsIs) Name() string { return "as-is" }
+
+func (AsIs) Candidates(source string, hints *RepairHints) []*RepairCandidate {
+	return []*RepairCandidate{{Url: source, Confidence: 1}}
+}
+
+// TrimBeforeArticle отрезает мусор перед артикулом в имени файла:
+// /img/X1452301.jpg -> /img/1452301.jpg
+type TrimBeforeArticle struct{}
+
+func (TrimBeforeArticle) Name() string { return "trim-before-article" }
+
+func (TrimBeforeArticle) Candidates(source string, hints *RepairHints) []*RepairCandidate {
+	d, f := path.Split(source)
+	if hints.Article == "" {
+		return nil
+	}
+	if i := strings.Index(f, hints.Article); i > 0 {
+		return []*RepairCandidate{{Url: d + f[i:], Confidence: 0.9}}
+	}
+	return nil
+}
+
+// ArticleDigitsPrefix заменяет начало имени файла на числовой префикс
+// артикула, когда имя совпадает с артикулом без последних символов.
+type ArticleDigitsPrefix struct {
+	// Сколько последних символов артикула могут отличаться
+	Tail int
+}
+
+func (ArticleDigitsPrefix) Name() string { return "article-digits-prefix" }
+
+func (s ArticleDigitsPrefix) Candidates(source string, hints *RepairHints) []*RepairCandidate {
+	d, f := path.Split(source)
+	article := hints.Article
+	if len(article) <= s.Tail || !strings.HasPrefix(f, article[:len(article)-s.Tail]) {
+		return nil
+	}
+
+	digits := leadingDigits(article)
+	if digits == "" || len(digits) > len(f) || strings.HasPrefix(f, digits) {
+		return nil
+	}
+	return []*RepairCandidate{{Url: d + digits + f[len(digits):], Confidence: 0.6}}
+}
+
+func leadingDigits(s string) (string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return s[:i]
+		}
+	}
+	return s
+}
@@ -0,0 +1,404 @@
+package libs
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScheduleConfig - конфиг режима serve, читается из json.
+type ScheduleConfig struct {
+	// Файл истории запусков
+	History string          `json:"history"`
+	Sites   []*SiteSchedule `json:"sites"`
+}
+
+type SiteSchedule struct {
+	Site     string   `json:"site"`
+	Schedule string   `json:"schedule"`
+	Stages   []string `json:"stages,omitempty"`
+	Stream   bool     `json:"stream,omitempty"`
+	// После обхода снять цены по регионам, см. RunRegions, только со stream
+	Regions bool `json:"regions,omitempty"`
+	// Длительности в формате time.ParseDuration: "6h", "10m"
+	Timeout string `json:"timeout,omitempty"`
+	Retries int    `json:"retries,omitempty"`
+	Backoff string `json:"backoff,omitempty"`
+}
+
+func LoadScheduleConfig(filename string) (*ScheduleConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := new(ScheduleConfig)
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, errors.New(filename + ": " + err.Error())
+	}
+	return config, nil
+}
+
+func parseDurationDefault(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// RunFunc запускает обход сайта: stages пустой - все стадии.
+type RunFunc func(ctx context.Context, stages []string) (error)
+
+// Job - сайт с расписанием в планировщике.
+type Job struct {
+	Site     string
+	Schedule *Schedule
+	Stages   []string
+	Run      RunFunc
+	Timeout  time.Duration
+	Retries  int
+	Backoff  time.Duration
+}
+
+// NewJob собирает задачу из строки конфига.
+func NewJob(s *SiteSchedule, run RunFunc) (*Job, error) {
+	schedule, err := ParseSchedule(s.Schedule)
+	if err != nil {
+		return nil, errors.New(s.Site + ": " + err.Error())
+	}
+	if s.Regions && !s.Stream {
+		return nil, errors.New(s.Site + ": regions need stream")
+	}
+	job := &Job{Site: s.Site, Schedule: schedule, Stages: s.Stages, Run: run, Retries: s.Retries}
+	if job.Timeout, err = parseDurationDefault(s.Timeout, 0); err != nil {
+		return nil, errors.New(s.Site + ": timeout: " + err.Error())
+	}
+	if job.Backoff, err = parseDurationDefault(s.Backoff, 10*time.Minute); err != nil {
+		return nil, errors.New(s.Site + ": backoff: " + err.Error())
+	}
+	return job, nil
+}
+
+const (
+	RunRunning   = "running"
+	RunOk        = "ok"
+	RunFailed    = "failed"
+	RunCancelled = "cancelled"
+)
+
+// RunRecord - одна попытка запуска сайта.
+type RunRecord struct {
+	Id       string     `xml:"id,attr" json:"id"`
+	Site     string     `xml:"site" json:"site"`
+	Trigger  string     `xml:"trigger" json:"trigger"`
+	Stages   []string   `xml:"stage,omitempty" json:"stages,omitempty"`
+	Attempt  int        `xml:"attempt" json:"attempt"`
+	Started  time.Time  `xml:"started" json:"started"`
+	Finished *time.Time `xml:"finished,omitempty" json:"finished,omitempty"`
+	Status   string     `xml:"status" json:"status"`
+	Error    string     `xml:"error,omitempty" json:"error,omitempty"`
+}
+
+// RunHistory - последние запуски, новые в конце.
+type RunHistory struct {
+	XMLName xml.Name     `xml:"runs"`
+	Runs    []*RunRecord `xml:"run"`
+}
+
+// Сколько последних запусков хранить в истории
+const MaxRunHistory = 1000
+
+func OpenRunHistory(filename string) (*RunHistory, error) {
+	history := &RunHistory{Runs: make([]*RunRecord, 0)}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := xml.NewDecoder(f).Decode(history); err != nil {
+		return nil, errors.New(filename + ": " + err.Error())
+	}
+	return history, nil
+}
+
+var ErrRunning = errors.New("site is already running")
+
+// Scheduler запускает задачи по расписанию, не давая двум запускам
+// одного сайта идти одновременно. Упавший запуск повторяется до Retries
+// раз с паузой Backoff, удваивающейся с каждой попыткой.
+type Scheduler struct {
+	Jobs        []*Job
+	HistoryPath string
+
+	m       sync.Mutex
+	history *RunHistory
+	running map[string]*activeRun
+}
+
+func NewScheduler(jobs []*Job, historyPath string) (*Scheduler, error) {
+	history, err := OpenRunHistory(historyPath)
+	if err != nil {
+		return nil, err
+	}
+	// Запуски, оборванные остановкой процесса, считаем отмененными
+	for _, r := range history.Runs {
+		if r.Status == RunRunning {
+			r.Status = RunCancelled
+		}
+	}
+	return &Scheduler{Jobs: jobs, HistoryPath: historyPath, history: history, running: make(map[string]*activeRun)}, nil
+}
+
+func (s *Scheduler) Job(site string) (*Job) {
+	for _, job := range s.Jobs {
+		if job.Site == site {
+			return job
+		}
+	}
+	return nil
+}
+
+// History возвращает копию истории запусков.
+func (s *Scheduler) History() ([]*RunRecord) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	runs := make([]*RunRecord, len(s.history.Runs))
+	for i, r := range s.history.Runs {
+		copy := *r
+		runs[i] = &copy
+	}
+	return runs
+}
+
+// Running - сайты, которые сейчас идут или ждут повтора.
+func (s *Scheduler) Running() ([]string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sites := make([]string, 0, len(s.running))
+	for site := range s.running {
+		sites = append(sites, site)
+	}
+	sort.Strings(sites)
+	return sites
+}
+
+// Run ждет срабатываний расписаний до отмены ctx. Запуски идут в фоне,
+// при отмене ctx Run дожидается их завершения.
+func (s *Scheduler) Run(ctx context.Context) (error) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	next := make(map[*Job]time.Time)
+	for _, job := range s.Jobs {
+		next[job] = job.Schedule.Next(time.Now())
+		Log.Site(job.Site).Info("scheduled", "schedule", job.Schedule.Spec, "next", next[job].Format(time.RFC3339))
+	}
+
+	for {
+		var soonest time.Time
+		for _, t := range next {
+			if !t.IsZero() && (soonest.IsZero() || t.Before(soonest)) {
+				soonest = t
+			}
+		}
+		if soonest.IsZero() {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+
+		timer := time.NewTimer(time.Until(soonest))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		for job, t := range next {
+			if t.After(now) {
+				continue
+			}
+			next[job] = job.Schedule.Next(now)
+			wg.Add(1)
+			go func(job *Job) {
+				defer wg.Done()
+				if err := s.Start(ctx, job, "schedule", job.Stages); err == ErrRunning {
+					Log.Site(job.Site).Warn("previous run is still going, skipped", "schedule", job.Schedule.Spec)
+				}
+			}(job)
+		}
+	}
+}
+
+// activeRun - идущий запуск сайта вместе с ожиданием повторов.
+type activeRun struct {
+	job *Job
+	// Текущая попытка
+	record *RunRecord
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Start запускает job и ждет конца всех попыток. Если сайт уже идет,
+// сразу возвращает ErrRunning.
+func (s *Scheduler) Start(ctx context.Context, job *Job, trigger string, stages []string) (error) {
+	active, _, err := s.launch(ctx, job, trigger, stages)
+	if err != nil {
+		return err
+	}
+	<-active.done
+	return active.err
+}
+
+// Launch запускает job в фоне и возвращает запись первой попытки.
+func (s *Scheduler) Launch(ctx context.Context, job *Job, trigger string, stages []string) (*RunRecord, error) {
+	_, record, err := s.launch(ctx, job, trigger, stages)
+	return record, err
+}
+
+func (s *Scheduler) launch(ctx context.Context, job *Job, trigger string, stages []string) (*activeRun, *RunRecord, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.running[job.Site] != nil {
+		return nil, nil, ErrRunning
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	logger := Log.Site(job.Site).With("trigger", trigger)
+	active := &activeRun{job: job, cancel: cancel, done: make(chan struct{})}
+	active.record = s.newRecord(job, trigger, stages, 1, logger)
+	s.running[job.Site] = active
+	first := *active.record
+
+	go func() {
+		defer close(active.done)
+		defer cancel()
+		active.err = s.run(ctx, active, trigger, stages, logger)
+		s.m.Lock()
+		delete(s.running, job.Site)
+		s.m.Unlock()
+	}()
+	return active, &first, nil
+}
+
+// Cancel отменяет идущий запуск сайта вместе с будущими повторами.
+func (s *Scheduler) Cancel(site string) (bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	active := s.running[site]
+	if active == nil {
+		return false
+	}
+	active.cancel()
+	return true
+}
+
+// Active возвращает текущую попытку идущего запуска сайта или nil.
+func (s *Scheduler) Active(site string) (*RunRecord) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	active := s.running[site]
+	if active == nil {
+		return nil
+	}
+	record := *active.record
+	return &record
+}
+
+func (s *Scheduler) run(ctx context.Context, active *activeRun, trigger string, stages []string, logger *Logger) (error) {
+	job := active.job
+	var err error
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			wait := job.Backoff << uint(attempt-2)
+			logger.Warn("run failed, retrying", "attempt", attempt, "wait", wait, "error", err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			s.m.Lock()
+			active.record = s.newRecord(job, trigger, stages, attempt, logger)
+			s.m.Unlock()
+		}
+		if err = s.attempt(ctx, job, active.record, stages, logger); err == nil || ctx.Err() != nil {
+			return err
+		}
+		if attempt > job.Retries {
+			break
+		}
+	}
+	logger.Error("run failed, no retries left", "attempts", job.Retries+1, "error", err)
+	return err
+}
+
+// newRecord заводит запись о попытке, вызывается под s.m.
+func (s *Scheduler) newRecord(job *Job, trigger string, stages []string, attempt int, logger *Logger) (*RunRecord) {
+	record := &RunRecord{
+		Id:      NewRunId(),
+		Site:    job.Site,
+		Trigger: trigger,
+		Stages:  stages,
+		Attempt: attempt,
+		Started: time.Now(),
+		Status:  RunRunning,
+	}
+	s.history.Runs = append(s.history.Runs, record)
+	s.saveHistory(logger)
+	return record
+}
+
+func (s *Scheduler) attempt(ctx context.Context, job *Job, record *RunRecord, stages []string, logger *Logger) (error) {
+	runCtx := ctx
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, job.Timeout)
+		defer cancel()
+	}
+	// У каждой попытки свой запуск: по нему отбираются логи и отчеты
+	runCtx = WithRun(WithLogger(runCtx, logger), record.Id)
+	logger = L(runCtx)
+	logger.Info("run started", "attempt", record.Attempt)
+	err := job.Run(runCtx, stages)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	finished := time.Now()
+	record.Finished = &finished
+	switch {
+	case err == nil:
+		record.Status = RunOk
+	case ctx.Err() != nil:
+		record.Status = RunCancelled
+		record.Error = err.Error()
+	default:
+		record.Status = RunFailed
+		record.Error = err.Error()
+	}
+	logger.Info("run finished", "status", record.Status, "duration", finished.Sub(record.Started), "error", err)
+	s.saveHistory(logger)
+	return err
+}
+
+// saveHistory вызывается под s.m.
+func (s *Scheduler) saveHistory(logger *Logger) {
+	if len(s.history.Runs) > MaxRunHistory {
+		s.history.Runs = s.history.Runs[len(s.history.Runs)-MaxRunHistory:]
+	}
+	if s.HistoryPath == "" {
+		return
+	}
+	if err := saveXML(s.history, s.HistoryPath); err != nil {
+		logger.Error("run history not saved", "file", s.HistoryPath, "error", err)
+	}
+}
@@ -0,0 +1,47 @@
+package libs
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+)
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// Годится и для urlset, и для sitemapindex
+type sitemapDocument struct {
+	XMLName xml.Name
+	Urls    []*sitemapLoc `xml:"url"`
+	Maps    []*sitemapLoc `xml:"sitemap"`
+}
+
+// FetchSitemap скачивает карту сайта и передает в emit каждый адрес страницы.
+// Вложенные карты из sitemapindex обходятся рекурсивно. Если emit вернул
+// ошибку, обход прекращается.
+func FetchSitemap(ctx context.Context, url string, emit func(url string) (error)) (error) {
+	res, cancel, err := Get(ctx, url)
+	if err != nil {
+		return err
+	}
+	doc := new(sitemapDocument)
+	err = xml.NewDecoder(res.Body).Decode(doc)
+	res.Body.Close()
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range doc.Maps {
+		if err := FetchSitemap(ctx, strings.TrimSpace(m.Loc), emit); err != nil {
+			return err
+		}
+	}
+	for _, u := range doc.Urls {
+		if err := emit(strings.TrimSpace(u.Loc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package libs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Stage - один шаг грабера: карта сайта, страницы, разбор, картинки...
+type Stage struct {
+	Name string
+	Run  func(ctx context.Context) (error)
+}
+
+func FindStage(stages []*Stage, name string) (*Stage, error) {
+	for _, stage := range stages {
+		if stage.Name == name {
+			return stage, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown stage %q", name)
+}
+
+// RunStages выполняет этапы с именами names по порядку, или все этапы,
+// если names пустой. Между этапами проверяется отмена контекста.
+func RunStages(ctx context.Context, site string, stages []*Stage, names []string) (error) {
+	run := stages
+	if len(names) > 0 {
+		run = make([]*Stage, 0, len(names))
+		for _, name := range names {
+			stage, err := FindStage(stages, name)
+			if err != nil {
+				return err
+			}
+			run = append(run, stage)
+		}
+	}
+
+	for _, stage := range run {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		started := time.Now()
+		logger := L(ctx).Site(site).Stage(stage.Name)
+		logger.Info("stage started")
+		if err := stage.Run(WithLogger(ctx, logger)); err != nil {
+			logger.Error("stage failed", "duration", time.Since(started), "error", err)
+			return fmt.Errorf("%s: %s: %v", site, stage.Name, err)
+		}
+		logger.Info("stage finished", "duration", time.Since(started))
+	}
+	return nil
+}
+
+// SignalContext отменяется по SIGINT/SIGTERM или через timeout, если он
+// больше нуля.
+func SignalContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(c)
+		select {
+		case s := <-c:
+			Log.Warn("stopping", "signal", s.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
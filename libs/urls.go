@@ -0,0 +1,100 @@
+package libs
+
+import (
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Рядом с каждой скачанной страницей лежит файл с ее итоговым адресом
+// (после редиректов), относительно него разрешаются ссылки при разборе.
+const PageUrlExt = ".url"
+
+// IsPageFile отличает сохраненные страницы от служебных файлов рядом с ними.
+func IsPageFile(name string) (bool) {
+	return strings.HasSuffix(name, ".html")
+}
+
+func savePageUrl(file string, pageUrl string) (error) {
+	return ioutil.WriteFile(file+PageUrlExt, []byte(pageUrl+"\n"), 0644)
+}
+
+// PageUrl возвращает адрес, с которого была скачана страница, или
+// пустую строку, если он не сохранен.
+func PageUrl(file string) (string) {
+	b, err := ioutil.ReadFile(file + PageUrlExt)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// DocumentBase возвращает базовый адрес для ссылок страницы: ее адрес
+// (или fallback, если он неизвестен) с учетом <base href>.
+func DocumentBase(pageUrl string, doc *goquery.Document, fallback string) (*url.URL) {
+	if pageUrl == "" {
+		pageUrl = fallback
+	}
+	base, err := url.Parse(pageUrl)
+	if err != nil {
+		base = new(url.URL)
+	}
+
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if b, err := base.Parse(strings.TrimSpace(href)); err == nil {
+			base = b
+		}
+	}
+	return base
+}
+
+// ItemProp - значение микроразметки schema.org: content, href или текст.
+func ItemProp(doc *goquery.Document, name string) (string) {
+	s := doc.Find("[itemprop=\"" + name + "\"]").First()
+	if value, ok := s.Attr("content"); ok {
+		return strings.TrimSpace(value)
+	}
+	if value, ok := s.Attr("href"); ok {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(s.Text())
+}
+
+// ResolveUrl разрешает относительную или protocol-relative ссылку
+// относительно base и нормализует результат. Пустые ссылки, якоря и
+// javascript: возвращаются как пустая строка.
+func ResolveUrl(base *url.URL, ref string) (string) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return NormalizeUrl(u)
+}
+
+// NormalizeUrl приводит схему и хост к нижнему регистру, убирает порт по
+// умолчанию и фрагмент, пустой путь заменяет на "/".
+func NormalizeUrl(u *url.URL) (string) {
+	n := *u
+	n.Scheme = strings.ToLower(n.Scheme)
+	n.Host = strings.ToLower(n.Host)
+	if n.Scheme == "http" && strings.HasSuffix(n.Host, ":80") {
+		n.Host = strings.TrimSuffix(n.Host, ":80")
+	}
+	if n.Scheme == "https" && strings.HasSuffix(n.Host, ":443") {
+		n.Host = strings.TrimSuffix(n.Host, ":443")
+	}
+	if n.Path == "" {
+		n.Path = "/"
+	}
+	n.Fragment = ""
+	n.RawFragment = ""
+	return n.String()
+}
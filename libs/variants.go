@@ -0,0 +1,252 @@
+package libs
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Variant - размер и формат, в котором картинка нужна маркетплейсу.
+type Variant struct {
+	Name string `json:"name"`
+	// Наибольшая сторона в пикселях, картинка не увеличивается
+	MaxSize int `json:"maxSize"`
+	// Дополнить картинку полями до квадрата MaxSize x MaxSize
+	Square bool `json:"square"`
+	// jpeg, png или webp (через внешний cwebp)
+	Format  string `json:"format"`
+	Quality int    `json:"quality"`
+	// Цвет полей для Square в виде #rrggbb, по умолчанию белый
+	Background string `json:"background"`
+}
+
+var DefaultVariants = []*Variant{
+	{Name: "large", MaxSize: 1000, Format: "jpeg", Quality: 90},
+	{Name: "thumb", MaxSize: 300, Format: "jpeg", Quality: 85},
+	{Name: "square", MaxSize: 1000, Square: true, Format: "jpeg", Quality: 90},
+}
+
+type ImageVariant struct {
+	Name   string `xml:"name,attr"`
+	File   string `xml:"file"`
+	Width  int    `xml:"width"`
+	Height int    `xml:"height"`
+}
+
+// LoadVariants читает список вариантов из json файла. Если файла нет,
+// возвращаются DefaultVariants.
+func LoadVariants(filename string) ([]*Variant, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return DefaultVariants, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	variants := make([]*Variant, 0)
+	if err := json.Unmarshal(b, &variants); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return variants, nil
+}
+
+// MakeVariants строит все варианты картинки source в каталоге dir.
+// Файлы называются <имя исходника>-<вариант>.<формат>.
+func MakeVariants(source string, dir string, variants []*Variant) ([]*ImageVariant, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	result := make([]*ImageVariant, 0, len(variants))
+	for _, v := range variants {
+		img := Fit(src, v.MaxSize)
+		if v.Square {
+			bg, err := parseColor(v.Background)
+			if err != nil {
+				return nil, err
+			}
+			img = Pad(img, v.MaxSize, bg)
+		}
+
+		file := filepath.Join(dir, base+"-"+v.Name+formatExt(v.Format))
+		if err := encodeImage(img, file, v); err != nil {
+			return nil, err
+		}
+		b := img.Bounds()
+		result = append(result, &ImageVariant{Name: v.Name, File: file, Width: b.Dx(), Height: b.Dy()})
+	}
+	return result, nil
+}
+
+func formatExt(format string) (string) {
+	if ext := ImageExt(format); ext != "" {
+		return ext
+	}
+	return ".jpg"
+}
+
+func encodeImage(img image.Image, file string, v *Variant) (error) {
+	if v.Format == "webp" {
+		return encodeWebp(img, file, v.Quality)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch v.Format {
+	case "png":
+		return png.Encode(f, img)
+	case "jpeg", "":
+		quality := v.Quality
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(f, img, &jpeg.Options{Quality: quality})
+	}
+	return fmt.Errorf("unsupported variant format %q", v.Format)
+}
+
+// encodeWebp пишет png во временный файл и перекодирует его утилитой cwebp,
+// в стандартной библиотеке кодировщика webp нет.
+func encodeWebp(img image.Image, file string, quality int) (error) {
+	cwebp, err := exec.LookPath("cwebp")
+	if err != nil {
+		return fmt.Errorf("webp variants need cwebp in PATH: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile("", "variant-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := png.Encode(tmp, img); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if quality == 0 {
+		quality = 80
+	}
+	out, err := exec.Command(cwebp, "-quiet", "-q", fmt.Sprint(quality), tmp.Name(), "-o", file).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cwebp: %v: %s", err, out)
+	}
+	return nil
+}
+
+func parseColor(s string) (color.Color, error) {
+	if s == "" {
+		return color.White, nil
+	}
+	var r, g, b uint8
+	if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return nil, fmt.Errorf("bad color %q", s)
+	}
+	return color.RGBA{R: r, G: g, B: b, A: 0xff}, nil
+}
+
+// Fit уменьшает картинку так, чтобы большая сторона была не больше max.
+// Маленькие картинки возвращаются как есть.
+func Fit(src image.Image, max int) (image.Image) {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if max <= 0 || (w <= max && h <= max) {
+		return src
+	}
+	if w >= h {
+		h = h * max / w
+		w = max
+	} else {
+		w = w * max / h
+		h = max
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return Resize(src, w, h)
+}
+
+// Resize уменьшает картинку усреднением по площади: каждый пиксель
+// результата - среднее покрываемых им пикселей исходника.
+func Resize(src image.Image, w int, h int) (*image.RGBA) {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := (y + 1) * sh / h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := (x + 1) * sw / w
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// Pad кладет картинку по центру квадрата size x size цвета bg.
+func Pad(src image.Image, size int, bg color.Color) (image.Image) {
+	b := src.Bounds()
+	if size < b.Dx() {
+		size = b.Dx()
+	}
+	if size < b.Dy() {
+		size = b.Dy()
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.ZP, draw.Src)
+	offset := image.Pt((size-b.Dx())/2, (size-b.Dy())/2)
+	draw.Draw(dst, b.Sub(b.Min).Add(offset), src, b.Min, draw.Over)
+	return dst
+}
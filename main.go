@@ -1,12 +1,95 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"sort"
 	"goods.ru/grab-it/grabers/compyou"
+	lib "goods.ru/grab-it/libs"
 )
 
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string) (error)
+}
+
+var commands = map[string]*command{
+	"run":         {"-site name [-stage a,b | -stream [-keep-pages] [-regions]] [-timeout 6h]", runCommand},
+	"golden":      {"[-update] [-site name]", goldenCommand},
+	"capture":     {"-site name -name fixture url", captureCommand},
+	"canary":      {"[-site name]", canaryCommand},
+	"diff":        {"-site name [-json diff.json] old.xml [new.xml]", diffCommand},
+	"history":     {"-site name [-product key] [-stats | -movers 20] [-from date] [-to date | -days 7] [-o out.csv]", historyCommand},
+	"match":       {"[-sites a,b] [-threshold 0.6] [-o matches.xml]", matchCommand},
+	"coordinator": {"-site name [-listen :8700]", coordinatorCommand},
+	"serve":       {"[-config schedule.json] [-api :8701]", serveCommand},
+	"worker":      {"-site name [-coordinator url] [-parallel 10]", workerCommand},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: grab-it <command> [flags]")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+name+" "+commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "progress: "+lib.ProgressEnv+"=bar|json|json:<file>|none, bar on a terminal and none otherwise, json writes "+lib.DefaultProgressFile)
+	fmt.Fprintln(os.Stderr, "logs: "+lib.LogFormatEnv+"=text|json|logfmt, "+lib.LogLevelEnv+"=info,site=debug")
+	fmt.Fprintln(os.Stderr, "metrics: "+lib.MetricsEnv+"=:9100 serves /metrics")
+	fmt.Fprintln(os.Stderr, "proxies: "+lib.ProxiesEnv+"=proxies.json sends requests through a proxy pool")
+}
+
 func main() {
-	if err := compyou.Run(); err != nil {
-		log.Fatal(err);
+	ctx, cancel := lib.SignalContext(context.Background(), 0)
+	defer cancel()
+
+	// Строки из стандартного log тоже попадают в структурный лог
+	log.SetFlags(0)
+	log.SetOutput(lib.Log.Writer())
+
+	if listen := os.Getenv(lib.MetricsEnv); listen != "" {
+		go func() {
+			if err := lib.ServeMetrics(listen); err != nil {
+				lib.Log.Error("metrics server failed", "listen", listen, "error", err)
+			}
+		}()
+	}
+
+	if filename := os.Getenv(lib.ProxiesEnv); filename != "" {
+		pool, err := lib.LoadProxyPool(filename)
+		if err != nil {
+			lib.Log.Error("proxies not loaded", "error", err)
+			os.Exit(1)
+		}
+		lib.UseProxies(pool)
+		go pool.Check(ctx)
+	}
+
+	// Команда - один запуск; serve заводит запуск на каждую попытку сам
+	if len(os.Args) < 2 || os.Args[1] != "serve" {
+		ctx = lib.WithRun(ctx, lib.NewRunId())
+	}
+
+	if len(os.Args) < 2 {
+		if err := compyou.Run(ctx); err != nil {
+			lib.Log.Error("run failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	c, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := c.run(ctx, os.Args[2:]); err != nil {
+		lib.Log.Error("command failed", "command", os.Args[1], "error", err)
+		os.Exit(1)
 	}
 }
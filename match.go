@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strings"
+	"goods.ru/grab-it/grabers"
+	lib "goods.ru/grab-it/libs"
+)
+
+// matchCommand связывает одинаковые товары разных сайтов по последним
+// прогонам, пишет отчет для проверки и печатает цены по группам.
+func matchCommand(ctx context.Context, args []string) (error) {
+	flags := flag.NewFlagSet("match", flag.ExitOnError)
+	siteNames := flags.String("sites", "", "comma separated sites, all by default")
+	threshold := flags.Float64("threshold", lib.DefaultMatchOptions.Threshold, "minimal confidence of a link")
+	output := flags.String("o", "matches.xml", "match report")
+	flags.Parse(args)
+
+	sites, err := grabers.Select("")
+	if err != nil {
+		return err
+	}
+	if *siteNames != "" {
+		sites = sites[:0]
+		for _, name := range strings.Split(*siteNames, ",") {
+			site, err := grabers.Get(strings.TrimSpace(name))
+			if err != nil {
+				return err
+			}
+			sites = append(sites, site)
+		}
+	}
+
+	products := make([]*lib.Product, 0)
+	for _, site := range sites {
+		siteProducts, err := site.Products()
+		if os.IsNotExist(err) {
+			lib.Log.Warn("no products yet, site skipped", "site", site.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		products = append(products, siteProducts...)
+	}
+
+	opts := lib.DefaultMatchOptions
+	opts.Threshold = *threshold
+	report := lib.MatchProducts(products, opts)
+	report.WriteSummary(os.Stdout)
+	return lib.SaveMatchReport(report, *output)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"time"
+	"goods.ru/grab-it/grabers"
+	lib "goods.ru/grab-it/libs"
+)
+
+// runCommand запускает этапы одного грабера. Без -stage выполняются все
+// этапы по порядку, с -stream - потоковый режим вместо этапов. Цены
+// обновленного каталога дописываются в историю сайта.
+func runCommand(ctx context.Context, args []string) (error) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	siteName := flags.String("site", "", "site to crawl")
+	stages := flags.String("stage", "", "comma separated stages, all by default")
+	timeout := flags.Duration("timeout", 0, "overall run deadline, none by default")
+	stream := flags.Bool("stream", false, "fetch, parse and store products concurrently instead of staged run")
+	keepPages := flags.Bool("keep-pages", false, "with -stream, also save raw pages to disk")
+	regions := flags.Bool("regions", false, "with -stream, capture prices of the products in every configured region after the run")
+	flags.Parse(args)
+
+	if *siteName == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	// Регионы снимаются по адресам товаров, которые пишет только потоковый
+	// режим: после стадий взялись бы товары прошлого потокового запуска
+	if *regions && !*stream {
+		return errors.New("-regions needs -stream")
+	}
+	site, err := grabers.Get(*siteName)
+	if err != nil {
+		return err
+	}
+
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	ctx, done, err := site.Session(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	started := time.Now()
+	if *stream {
+		err = site.Stream(ctx, *keepPages)
+	} else {
+		names := make([]string, 0)
+		if *stages != "" {
+			names = strings.Split(*stages, ",")
+		}
+		err = lib.RunStages(ctx, site.Name, site.Stages, names)
+	}
+	if err == nil && *regions {
+		err = site.Regions(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return site.Record(ctx, started)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"goods.ru/grab-it/grabers"
+	lib "goods.ru/grab-it/libs"
+	"time"
+)
+
+// serveCommand - долгоживущий режим: сайты запускаются по расписанию
+// из конфига, история запусков пишется в файл. Рядом работает http api
+// для ручных запусков и чтения результатов, пустой -api его отключает.
+func serveCommand(ctx context.Context, args []string) (error) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	config := flags.String("config", "schedule.json", "schedule config")
+	listen := flags.String("api", ":8701", "control api address")
+	flags.Parse(args)
+
+	scheduler, err := newScheduler(*config)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	apiErr := make(chan error, 1)
+	if *listen != "" {
+		api := lib.NewControlAPI(ctx, scheduler, apiSites())
+		go func() {
+			apiErr <- api.Serve(ctx, *listen)
+		}()
+	}
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- scheduler.Run(ctx)
+	}()
+
+	select {
+	case err = <-apiErr:
+		// api не поднялся (например, занят порт) - останавливаем и расписание
+		cancel()
+		<-runErr
+	case err = <-runErr:
+	}
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+func apiSites() ([]*lib.APISite) {
+	sites := make([]*lib.APISite, 0, len(grabers.Sites))
+	for _, site := range grabers.Sites {
+		stages := make([]string, 0, len(site.Stages))
+		for _, stage := range site.Stages {
+			stages = append(stages, stage.Name)
+		}
+		sites = append(sites, &lib.APISite{
+			Name:       site.Name,
+			Run:        siteRunner(site, false, false),
+			Stages:     stages,
+			Products:   site.Products,
+			ErrorsPath: site.ErrorsPath,
+			StatsPath:  site.StatsPath,
+		})
+	}
+	return sites
+}
+
+func newScheduler(filename string) (*lib.Scheduler, error) {
+	config, err := lib.LoadScheduleConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*lib.Job, 0, len(config.Sites))
+	for _, s := range config.Sites {
+		site, err := grabers.Get(s.Site)
+		if err != nil {
+			return nil, err
+		}
+		job, err := lib.NewJob(s, siteRunner(site, s.Stream, s.Regions))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return lib.NewScheduler(jobs, config.History)
+}
+
+// siteRunner запускает стадии сайта или потоковый режим, с regions -
+// потом еще проход по регионам. Цены обновленного каталога попадают в историю.
+func siteRunner(site *grabers.Site, stream bool, regions bool) (lib.RunFunc) {
+	return func(ctx context.Context, stages []string) (error) {
+		ctx, done, err := site.Session(ctx)
+		if err != nil {
+			return err
+		}
+		defer done()
+		started := time.Now()
+		if stream {
+			err = site.Stream(ctx, false)
+		} else {
+			err = lib.RunStages(ctx, site.Name, site.Stages, stages)
+		}
+		if err == nil && regions {
+			err = site.Regions(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		return site.Record(ctx, started)
+	}
+}